@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff returns delays between retries that double from min up to max.  Each delay is picked at
+// random from the upper half of the current one, so nodes started together spread out.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+	cur time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{min: time.Millisecond * 100, max: time.Second * 5}
+}
+
+func (b *backoff) next() time.Duration {
+	if b.cur < b.min {
+		b.cur = b.min
+	} else if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	half := b.cur / 2
+	return half + time.Duration(rand.Int63n(int64(b.cur-half)+1))
+}
+
+// sleepUntil sleeps for the next delay, or until deadline if that is sooner
+func (b *backoff) sleepUntil(deadline time.Time) {
+	d := b.next()
+	if left := time.Until(deadline); left < d {
+		d = left
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
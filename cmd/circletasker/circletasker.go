@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,6 +16,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,122 +38,802 @@ type circleTasker struct {
 	sourceHost   string
 	listenHost   string
 	readyTimeout time.Duration
+	leaseTimeout time.Duration
+	holdTimeout  time.Duration
 	client       http.Client
 	listening    chan struct{}
 	out          io.Writer
 	logOut       io.Writer
+
+	reportItem     string
+	reportExitCode int
+	reportDuration time.Duration
+	reportMessage  string
+
+	itemEnv           string
+	heartbeatInterval time.Duration
+	prevResults       string
+	journal           string
+	resume            bool
+	failFast          bool
+	retries           int
+	batch             int
+	batchTarget       time.Duration
+	token             string
+
+	tlsCert      string
+	tlsKey       string
+	clientCA     string
+	selfSigned   bool
+	selfSignedCA string
+	caFile       string
+	certFile     string
+	keyFile      string
+
+	workers int
+	outMu   sync.Mutex
+
+	// itemsStopped is closed once the process gets stopSignal, which running items get passed on
+	itemsStopped chan struct{}
+	stopSignal   os.Signal
+
+	caps string
+
+	joinGrace    time.Duration
+	waitAll      bool
+	idleTimeout  time.Duration
+	drainTimeout time.Duration
+
+	reconnectTimeout time.Duration
+
+	itemTimeoutFlag time.Duration
+	timeoutFactor   float64
+	killAfter       time.Duration
+
+	logDir      string
+	logMaxBytes int64
 }
 
 type splitServer struct {
-	listenHost     string
-	listening      chan struct{}
-	partsToServe   []string
-	log            *log.Logger
-	maxClientIndex int
-
-	server        http.Server
-	haveToldDone  map[int]struct{}
-	doneWaitGroup sync.WaitGroup
-	mu            sync.Mutex
-	indexIsReady  map[int]struct{}
+	listenHost   string
+	listening    chan struct{}
+	partsToServe []string
+	log          *log.Logger
+	nodeTotal    int
+
+	server       http.Server
+	haveToldDone map[int]struct{}
+	mu           sync.Mutex
+	indexIsReady map[int]struct{}
 
 	processResults   map[string]time.Duration
-	processStartTime map[int]startTime
+	processStartTime map[int][]startTime
+
+	leaseTimeout  time.Duration
+	holdTimeout   time.Duration
+	lostIndexes   map[int]struct{}
+	expiredLeases []leaseExpiry
+	workChanged   *sync.Cond
+
+	outcomes map[string]itemOutcome
+	expected map[string]time.Duration
+
+	journal     *json.Encoder
+	journalFile *os.File
+
+	metrics serverMetrics
+
+	failFast bool
+	draining bool
+	skipped  []string
+
+	retries  int
+	attempts map[string][]itemOutcome
+
+	batchTarget time.Duration
+
+	itemIDs map[string]string
+
+	token string
+
+	tlsConfig *tls.Config
+
+	attrs itemAttrs
+	caps  map[int][]string
+
+	seen         map[int]time.Time
+	joinGrace    time.Duration
+	joinDeadline time.Time
+	idleTimeout  time.Duration
+
+	interrupted  string
+	notStarted   []string
+	drainTimeout time.Duration
+
+	lastNext    map[int]lastNext
+	nextPending map[int]string
+	lastReport  map[int]lastReport
 }
 
 type startTime struct {
-	sentItem string
-	sendTime time.Time
+	sentItem  string
+	sendTime  time.Time
+	renewTime time.Time
+}
+
+type leaseExpiry struct {
+	Item      string    `json:"item"`
+	Index     int       `json:"index"`
+	StartTime time.Time `json:"start_time"`
+	RenewTime time.Time `json:"renew_time"`
+	Expired   time.Time `json:"expired"`
+}
+
+// itemReport is sent by a client once it finishes running an item
+type itemReport struct {
+	Item     string        `json:"item,omitempty"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Message  string        `json:"message,omitempty"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Log      string        `json:"log,omitempty"`
+}
+
+type itemOutcome struct {
+	Index    int           `json:"index"`
+	Attempt  int           `json:"attempt"`
+	Passed   bool          `json:"passed"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+	Message  string        `json:"message,omitempty"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Log      string        `json:"log,omitempty"`
+}
+
+type runResults struct {
+	Durations map[string]time.Duration `json:"durations"`
+	Outcomes  map[string]itemOutcome   `json:"outcomes,omitempty"`
+	Expired   []leaseExpiry            `json:"expired,omitempty"`
+	Skipped   []string                 `json:"skipped,omitempty"`
+	Attempts  map[string][]itemOutcome `json:"attempts,omitempty"`
+	Flaky     []string                 `json:"flaky,omitempty"`
+
+	Unscheduled []string `json:"unscheduled,omitempty"`
+
+	Interrupted string   `json:"interrupted,omitempty"`
+	InFlight    []string `json:"in_flight,omitempty"`
+	NotStarted  []string `json:"not_started,omitempty"`
 }
 
 const sourceIndexHeader = "X-index"
 
+const batchHeader = "X-batch"
+
+const bearerPrefix = "Bearer "
+
+const unixPrefix = "unix:"
+
+const (
+	heartbeatPath = "/heartbeat"
+	reportPath    = "/report"
+)
+
+// protocolError is a request the server rejects.  The plain text protocol only sends back the
+// status and message, v1 also sends the code.
+type protocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	status  int
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// errHold tells a node to ask again, because other nodes may still give items back
+var errHold = &protocolError{Code: "retry", Message: "Items may still come back from other nodes", status: http.StatusServiceUnavailable}
+
+func (s *splitServer) reject(status int, code string, format string, args ...interface{}) *protocolError {
+	msg := fmt.Sprintf(format, args...)
+	s.log.Println(msg)
+	s.metrics.protocolError(code)
+	return &protocolError{Code: code, Message: msg, status: status}
+}
+
+func writeTextError(rw http.ResponseWriter, perr *protocolError) {
+	if perr == errHold {
+		rw.Header().Set("Retry-After", "1")
+	}
+	rw.WriteHeader(perr.status)
+	_, err := io.WriteString(rw, perr.Message)
+	logIfNotNil(err, "Cannot write response to client")
+}
+
+func flushResponse(rw http.ResponseWriter) {
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (s *splitServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if !s.authorized(req) {
+		perr := s.reject(http.StatusUnauthorized, "unauthorized", "Rejecting unauthenticated %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		if strings.HasPrefix(req.URL.Path, v1Prefix) {
+			writeV1(rw, v1Response{Error: perr})
+			return
+		}
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == statusPath {
+		s.serveStatus(rw)
+		return
+	}
+	if req.URL.Path == metricsPath {
+		s.serveMetrics(rw)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, v1Prefix) {
+		s.serveV1(rw, req)
+		return
+	}
 	indexStr := req.Header.Get(sourceIndexHeader)
-	index, err := strconv.ParseInt(indexStr, 10, 64)
+	index, err := strconv.Atoi(indexStr)
 	if err != nil {
-		s.log.Printf("Invalid X-index %s", indexStr)
-		rw.WriteHeader(http.StatusBadRequest)
-		_, err := io.WriteString(rw, fmt.Sprintf("Invalid X-index %s", indexStr))
-		logIfNotNil(err, "Cannot write response to client")
+		writeTextError(rw, s.reject(http.StatusBadRequest, "invalid_index", "Invalid X-index %s", indexStr))
 		return
 	}
-	if index < 0 || index >= int64(s.maxClientIndex) {
-		s.log.Printf("Invalid index %d", index)
-		rw.WriteHeader(http.StatusBadRequest)
+	if perr := s.checkIndex(index); perr != nil {
+		writeTextError(rw, perr)
 		return
 	}
 	if req.Method == "HEAD" {
-		_, alreadyTold := s.indexIsReady[int(index)]
-		if alreadyTold {
-			s.log.Printf("Telling index %d twice that I am ready", index)
-			rw.WriteHeader(http.StatusBadRequest)
-			_, err := io.WriteString(rw, fmt.Sprintf("Index %d was already told to stop", index))
-			logIfNotNil(err, "Cannot write response to client")
+		s.ready(index)
+		return
+	}
+	if req.URL.Path == heartbeatPath {
+		if perr := s.renew(index); perr != nil {
+			writeTextError(rw, perr)
+		}
+		return
+	}
+	if req.URL.Path == reportPath {
+		var rep itemReport
+		if err := json.NewDecoder(req.Body).Decode(&rep); err != nil {
+			writeTextError(rw, s.reject(http.StatusBadRequest, "invalid_report", "Invalid report from index %d: %s", index, err.Error()))
 			return
 		}
-		s.indexIsReady[int(index)] = struct{}{}
+		if _, perr := s.applyReport(index, rep, ""); perr != nil {
+			writeTextError(rw, perr)
+		}
+		return
+	}
+	// Plain text clients do not report, asking for the next item means the last one passed
+	s.finishItem(index, time.Now())
+	items, newlyDone, perr := s.next(index, batchSize(req), splitList(req.Header.Get(capsHeader)), "")
+	if perr != nil {
+		writeTextError(rw, perr)
 		return
 	}
+	if len(items) != 0 {
+		_, err := io.WriteString(rw, strings.Join(items, "\n"))
+		logIfNotNil(err, "Cannot write response to client")
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	if newlyDone {
+		flushResponse(rw)
+	}
+}
+
+// authorized returns true if req carries the server token, or the server has none
+func (s *splitServer) authorized(req *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(bearerPrefix):]), []byte(s.token)) == 1
+}
+
+func (s *splitServer) checkIndex(index int) *protocolError {
+	if index < 0 {
+		return s.reject(http.StatusBadRequest, "invalid_index", "Invalid index %d", index)
+	}
+	return nil
+}
+
+// ready checks index in.  Nodes may check in again while they wait for the others.
+func (s *splitServer) ready(index int) {
+	if _, alreadyReady := s.indexIsReady[index]; alreadyReady {
+		s.touch(index, time.Now())
+		return
+	}
+	s.markReady(index)
+}
+
+func (s *splitServer) renew(index int) *protocolError {
+	s.touch(index, time.Now())
+	held := s.processStartTime[index]
+	if len(held) == 0 {
+		return s.reject(http.StatusConflict, "no_lease", "Heartbeat from index %d without a leased item", index)
+	}
+	now := time.Now()
+	for i := range held {
+		held[i].renewTime = now
+	}
+	return nil
+}
+
+// applyReport records the report of an item index holds.  It returns true if the item failed and
+// goes back to the queue to be retried.  A non empty requestID is kept with the answer, so a retry
+// of a report that was already recorded is answered the same instead of as a report without a lease.
+func (s *splitServer) applyReport(index int, rep itemReport, requestID string) (bool, *protocolError) {
+	s.touch(index, time.Now())
+	if last, exists := s.lastReport[index]; exists && requestID != "" && last.requestID == requestID {
+		s.log.Printf("Answering report %s from index %d again", requestID, index)
+		return last.retrying, nil
+	}
+	st, exists := s.heldItem(index, rep.Item)
+	if !exists {
+		return false, s.reject(http.StatusConflict, "no_lease", "Report for %s from index %d which does not hold it", rep.Item, index)
+	}
+	if rep.Duration <= 0 {
+		rep.Duration = time.Since(st.sendTime)
+	}
+	rep.Item = st.sentItem
+	retrying := s.recordReport(index, rep, time.Now(), requestID)
+	if rep.ExitCode != 0 {
+		s.log.Printf("%s failed on %d with exit code %d", st.sentItem, index, rep.ExitCode)
+	}
+	s.workChanged.Broadcast()
+	return retrying, nil
+}
+
+// next hands index up to n more items that need no more than caps.  No items means index is done.
+// If this is the first time index is told, the caller must flush the response before it unlocks
+// mu, as the server may stop once index is done.  A non empty requestID is kept with the answer,
+// so a retry of the request can be answered the same.
+func (s *splitServer) next(index int, n int, caps []string, requestID string) ([]string, bool, *protocolError) {
+	defer s.workChanged.Broadcast()
 	now := time.Now()
-	lastItem, exists := s.processStartTime[int(index)]
-	if exists {
-		s.processResults[lastItem.sentItem] = now.Sub(lastItem.sendTime)
-		delete(s.processStartTime, int(index))
+	s.touch(index, now)
+	s.caps[index] = caps
+	if _, lost := s.lostIndexes[index]; lost {
+		s.log.Printf("Index %d lost its lease and was already released", index)
+		return nil, false, nil
+	}
+	if !s.waitForWork(index) {
+		s.log.Printf("Holding index %d: other nodes may still give items back", index)
+		return nil, false, errHold
+	}
+	if s.hasWorkFor(index) {
+		toRet := s.pickBatch(index, n, now, requestID)
+		s.log.Printf("%s -> %d", strings.Join(toRet, ", "), index)
+		return toRet, false, nil
+	}
+	if _, alreadyTold := s.haveToldDone[index]; alreadyTold {
+		return nil, false, s.reject(http.StatusBadRequest, "duplicate_done", "Index %d was already told to stop", index)
 	}
+	s.markDone(index, requestID)
 	if len(s.partsToServe) != 0 {
-		var toRet string
-		toRet, s.partsToServe = s.partsToServe[0], s.partsToServe[1:]
-		s.log.Printf("%s -> %d", toRet, index)
-		_, err := io.WriteString(rw, toRet)
-		logIfNotNil(err, "Cannot write response to client")
-		s.processStartTime[int(index)] = startTime{
-			sentItem: toRet,
-			sendTime: now,
+		s.log.Printf("Done: %d, it cannot run any of the %d queued items", index, len(s.partsToServe))
+	} else {
+		s.log.Printf("Done: %d", index)
+	}
+	return nil, true, nil
+}
+
+// setQueue starts serving items.  Item IDs are their position in the first queue, unless stdin
+// gave them one.
+func (s *splitServer) setQueue(items []string) {
+	s.partsToServe = append([]string(nil), items...)
+	s.itemIDs = make(map[string]string, len(items))
+	for i, item := range items {
+		s.itemIDs[item] = strconv.Itoa(i + 1)
+		if id, exists := s.attrs.IDs[item]; exists {
+			s.itemIDs[item] = id
+		}
+	}
+}
+
+func (s *splitServer) markReady(index int) {
+	s.record(journalEvent{Event: "ready", Index: index})
+	s.touch(index, time.Now())
+	s.indexIsReady[index] = struct{}{}
+}
+
+// heldItem returns the item index holds named item.  An empty item matches if index holds just one.
+func (s *splitServer) heldItem(index int, item string) (startTime, bool) {
+	held := s.processStartTime[index]
+	if item == "" && len(held) == 1 {
+		return held[0], true
+	}
+	for _, st := range held {
+		if st.sentItem == item {
+			return st, true
 		}
+	}
+	return startTime{}, false
+}
+
+// release stops index from holding item.  Items of a batch run one after the other, so the next
+// item held by index starts now.
+func (s *splitServer) release(index int, item string, now time.Time) {
+	held := s.processStartTime[index]
+	for i, st := range held {
+		if st.sentItem == item {
+			held = append(held[:i:i], held[i+1:]...)
+			break
+		}
+	}
+	if len(held) == 0 {
+		delete(s.processStartTime, index)
 		return
 	}
-	_, alreadyTold := s.haveToldDone[int(index)]
-	if alreadyTold {
-		s.log.Printf("Telling index %d twice", index)
-		rw.WriteHeader(http.StatusBadRequest)
-		_, err := io.WriteString(rw, fmt.Sprintf("Index %d was already told to stop", index))
-		logIfNotNil(err, "Cannot write response to client")
+	held[0].sendTime = now
+	s.processStartTime[index] = held
+}
+
+// finishItem records the durations of the items index holds, if any.  Items of a batch that were
+// never reported split the time of the batch evenly.
+func (s *splitServer) finishItem(index int, now time.Time) {
+	held := s.processStartTime[index]
+	if len(held) == 0 {
 		return
 	}
-	s.haveToldDone[int(index)] = struct{}{}
-	s.log.Printf("Done: %d", index)
-	rw.WriteHeader(http.StatusNoContent)
-	if f, ok := rw.(http.Flusher); ok {
-		f.Flush()
+	s.record(journalEvent{Event: "complete", Time: now, Index: index})
+	each := now.Sub(held[0].sendTime) / time.Duration(len(held))
+	for _, st := range held {
+		s.processResults[st.sentItem] = each
+		s.metrics.completed("unknown", each)
+	}
+	delete(s.processStartTime, index)
+}
+
+// requeueUnreported puts the items index holds but never reported back at the front of the queue.
+// Clients that report ask for more items only once they reported what they hold, so these items
+// never ran, or the node that ran them was restarted.
+func (s *splitServer) requeueUnreported(index int, now time.Time) {
+	held := s.processStartTime[index]
+	if len(held) == 0 {
+		return
+	}
+	s.record(journalEvent{Event: "requeue", Time: now, Index: index})
+	delete(s.processStartTime, index)
+	items := make([]string, 0, len(held))
+	for _, st := range held {
+		items = append(items, st.sentItem)
+	}
+	s.log.Printf("Requeueing %s: index %d asked for more without reporting them", strings.Join(items, ", "), index)
+	if s.draining {
+		s.skipped = append(s.skipped, items...)
+	} else {
+		s.partsToServe = append(items, s.partsToServe...)
+	}
+}
+
+func batchSize(req *http.Request) int {
+	n, err := strconv.Atoi(req.Header.Get(batchHeader))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// pickBatch hands out up to n items to index.  With a batch target, it stops once the expected
+// duration of the batch reaches the target.
+func (s *splitServer) pickBatch(index int, n int, now time.Time, requestID string) []string {
+	ret := make([]string, 0, n)
+	var expected time.Duration
+	for len(ret) < n && s.hasWorkFor(index) {
+		if len(ret) != 0 && s.batchTarget > 0 && s.expected != nil && expected >= s.batchTarget {
+			break
+		}
+		item := s.pickItem(index)
+		s.handOut(index, item, now, requestID, len(ret) == 0)
+		ret = append(ret, item)
+		expected += s.expected[item]
+	}
+	return ret
+}
+
+// handOut removes item from the queue and leases it to index, in answer to requestID.  The first
+// item of an answer replaces the last answer to index.
+func (s *splitServer) handOut(index int, item string, now time.Time, requestID string, first bool) {
+	s.record(journalEvent{Event: "serve", Time: now, Index: index, Item: item, RequestID: requestID, First: first})
+	if first {
+		s.answered(index, requestID, false)
+	}
+	if last, exists := s.lastNext[index]; exists {
+		last.items = append(last.items, item)
+		s.lastNext[index] = last
+	}
+	s.metrics.itemsServed++
+	for i, part := range s.partsToServe {
+		if part == item {
+			s.partsToServe = append(s.partsToServe[:i:i], s.partsToServe[i+1:]...)
+			break
+		}
+	}
+	s.processStartTime[index] = append(s.processStartTime[index], startTime{
+		sentItem:  item,
+		sendTime:  now,
+		renewTime: now,
+	})
+}
+
+func (s *splitServer) markDone(index int, requestID string) {
+	s.record(journalEvent{Event: "done", Index: index, RequestID: requestID})
+	s.answered(index, requestID, true)
+	s.touch(index, time.Now())
+	s.haveToldDone[index] = struct{}{}
+}
+
+// answered starts the answer to requestID from index, forgetting the last one.  Answers to
+// requests without an ID are not kept, as they cannot be retried.
+func (s *splitServer) answered(index int, requestID string, done bool) {
+	delete(s.lastNext, index)
+	if requestID != "" {
+		s.lastNext[index] = lastNext{requestID: requestID, done: done}
+	}
+}
+
+// recordReport records the outcome of an item, returning true if it failed and is queued again
+func (s *splitServer) recordReport(index int, rep itemReport, now time.Time, requestID string) bool {
+	s.record(journalEvent{Event: "report", Time: now, Index: index, Report: &rep, RequestID: requestID})
+	retrying := s.applyOutcome(index, rep, now)
+	delete(s.lastReport, index)
+	if requestID != "" {
+		s.lastReport[index] = lastReport{requestID: requestID, retrying: retrying}
+	}
+	return retrying
+}
+
+// applyOutcome releases the item of rep and keeps its outcome, returning true if it is queued again
+func (s *splitServer) applyOutcome(index int, rep itemReport, now time.Time) bool {
+	s.release(index, rep.Item, now)
+	s.processResults[rep.Item] = rep.Duration
+	if rep.ExitCode == 0 {
+		s.metrics.completed("passed", rep.Duration)
+	} else if rep.TimedOut {
+		s.metrics.completed("timeout", rep.Duration)
+	} else {
+		s.metrics.completed("failed", rep.Duration)
+	}
+	outcome := itemOutcome{
+		Index:    index,
+		Attempt:  len(s.attempts[rep.Item]) + 1,
+		Passed:   rep.ExitCode == 0,
+		ExitCode: rep.ExitCode,
+		Duration: rep.Duration,
+		Message:  rep.Message,
+		TimedOut: rep.TimedOut,
+		Log:      rep.Log,
+	}
+	s.outcomes[rep.Item] = outcome
+	s.attempts[rep.Item] = append(s.attempts[rep.Item], outcome)
+	if rep.ExitCode != 0 && outcome.Attempt <= s.retries && !s.draining {
+		s.log.Printf("Retrying %s after attempt %d failed on %d", rep.Item, outcome.Attempt, index)
+		s.partsToServe = append(s.partsToServe, rep.Item)
+		return true
+	}
+	if rep.ExitCode != 0 {
+		s.skipAfter(rep.Item)
+	}
+	if rep.ExitCode != 0 && s.failFast && !s.draining {
+		s.log.Printf("Failing fast after %s: skipping %d items", rep.Item, len(s.partsToServe))
+		s.draining = true
+		s.skipped = append(s.skipped, s.partsToServe...)
+		s.partsToServe = nil
+	}
+	return false
+}
+
+// pickItem returns the first queued item index can run that has not already failed on it, or the
+// first item index can run if they all have
+func (s *splitServer) pickItem(index int) string {
+	first := ""
+	for _, item := range s.partsToServe {
+		if !s.canRun(index, item) {
+			continue
+		}
+		if !s.failedOn(item, index) {
+			return item
+		}
+		if first == "" {
+			first = item
+		}
+	}
+	return first
+}
+
+func (s *splitServer) failedOn(item string, index int) bool {
+	for _, attempt := range s.attempts[item] {
+		if attempt.Index == index && !attempt.Passed {
+			return true
+		}
+	}
+	return false
+}
+
+// flaky returns the items that passed only after a retry
+func (s *splitServer) flaky() []string {
+	ret := make([]string, 0)
+	for item, attempts := range s.attempts {
+		if len(attempts) > 1 && attempts[len(attempts)-1].Passed {
+			ret = append(ret, item)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// othersMayRequeue returns true if an index other than index runs an item that may still come
+// back to the queue, because its lease expires or it is retried
+func (s *splitServer) othersMayRequeue(index int) bool {
+	if (s.leaseTimeout == 0 && s.retries == 0) || s.draining {
+		return false
+	}
+	for i := range s.processStartTime {
+		if i != index {
+			return true
+		}
+	}
+	return false
+}
+
+// mayGetWork returns true if another node could still give index an item to run
+func (s *splitServer) mayGetWork(index int) bool {
+	return s.othersMayRequeue(index) || s.othersMayUnblock(index)
+}
+
+// waitForWork blocks while index has nothing to run but another node could still give it an item.
+// It returns false if that is still the case after holdTimeout.
+func (s *splitServer) waitForWork(index int) bool {
+	if s.hasWorkFor(index) || !s.mayGetWork(index) {
+		return true
+	}
+	deadline := time.Now().Add(s.holdTimeout)
+	t := time.AfterFunc(s.holdTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.workChanged.Broadcast()
+	})
+	defer t.Stop()
+	for !s.hasWorkFor(index) && s.mayGetWork(index) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		s.workChanged.Wait()
+	}
+	return true
+}
+
+func (s *splitServer) expireLeases(now time.Time) {
+	defer s.workChanged.Broadcast()
+	s.expireIdle(now)
+	if s.leaseTimeout <= 0 {
+		return
+	}
+	expired := make([]int, 0, len(s.processStartTime))
+	for index, held := range s.processStartTime {
+		if now.Sub(held[0].renewTime) >= s.leaseTimeout {
+			expired = append(expired, index)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(expired)))
+	for _, index := range expired {
+		held := s.processStartTime[index]
+		s.log.Printf("Lease on %d items for index %d expired: last renewed %s ago", len(held), index, now.Sub(held[0].renewTime))
+		s.expireLease(index, now)
+	}
+}
+
+// expireLease puts the items index holds back at the front of the queue and releases index
+func (s *splitServer) expireLease(index int, now time.Time) {
+	s.record(journalEvent{Event: "expire", Time: now, Index: index})
+	held := s.processStartTime[index]
+	delete(s.processStartTime, index)
+	items := make([]string, 0, len(held))
+	for _, st := range held {
+		items = append(items, st.sentItem)
+		s.expiredLeases = append(s.expiredLeases, leaseExpiry{
+			Item:      st.sentItem,
+			Index:     index,
+			StartTime: st.sendTime,
+			RenewTime: st.renewTime,
+			Expired:   now,
+		})
+	}
+	if s.draining {
+		s.skipped = append(s.skipped, items...)
+	} else {
+		s.partsToServe = append(items, s.partsToServe...)
+	}
+	if _, alreadyTold := s.haveToldDone[index]; !alreadyTold {
+		s.haveToldDone[index] = struct{}{}
+		s.lostIndexes[index] = struct{}{}
+	}
+}
+
+func (s *splitServer) expireLoop(stop <-chan struct{}) {
+	interval := s.leaseTimeout / 4
+	if s.leaseTimeout <= 0 || (s.idleTimeout > 0 && s.idleTimeout < s.leaseTimeout) {
+		interval = s.idleTimeout / 4
+	}
+	if interval < time.Millisecond*10 {
+		interval = time.Millisecond * 10
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			s.mu.Lock()
+			s.expireLeases(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *splitServer) results() runResults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return runResults{
+		Durations: s.processResults,
+		Outcomes:  s.outcomes,
+		Expired:   s.expiredLeases,
+		Skipped:   s.skipped,
+		Attempts:  s.attempts,
+		Flaky:     s.flaky(),
+
+		Unscheduled: append([]string(nil), s.partsToServe...),
+
+		Interrupted: s.interrupted,
+		InFlight:    s.runningItems(),
+		NotStarted:  s.notStarted,
 	}
-	s.doneWaitGroup.Done()
 }
 
 func (s *splitServer) start() error {
 	errChan := make(chan error, 1)
-	l, err := net.Listen("tcp", s.listenHost)
+	l, err := listen(s.listenHost)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		logIfNotNil(l.Close(), "Cannot close listen port")
-	}()
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
 	s.server.Handler = s
 	s.server.ErrorLog = s.log
 	go func() {
 		close(s.listening)
 		errChan <- s.server.Serve(l)
 	}()
-	s.doneWaitGroup.Wait()
-	select {
-	case err := <-errChan:
+	if s.leaseTimeout > 0 || s.idleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.expireLoop(stop)
+	}
+	s.waitFinished()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	logIfNotNil(s.server.Shutdown(ctx), "Cannot shut down the server cleanly")
+	if err := <-errChan; err != http.ErrServerClosed {
 		return err
-	default:
-		return nil
 	}
+	return nil
 }
 
 var mainInstance = circleTasker{
@@ -169,7 +854,7 @@ func (j *circleTasker) flagInit() error {
 			return err
 		}
 	}
-	j.flags.IntVar(&j.nodeTotal, "node_total", int(nodeTotal), "Number of nodes to split into")
+	j.flags.IntVar(&j.nodeTotal, "node_total", int(nodeTotal), "Number of nodes expected to join")
 
 	nodeIndexStr := os.Getenv("CIRCLE_NODE_INDEX")
 	nodeIndex := int64(0)
@@ -181,11 +866,51 @@ func (j *circleTasker) flagInit() error {
 	j.flags.IntVar(&j.nodeIndex, "node_index", int(nodeIndex), "Index of the node we're building")
 
 	j.flags.StringVar(&j.runRes, "run_res", filepath.Join(os.Getenv("CIRCLE_ARTIFACTS"), "circletasker.json"), "Filename to store results into")
-	j.flags.StringVar(&j.sourceHost, "source_host", "localhost", "Source host to get information from")
-	j.flags.StringVar(&j.listenHost, "listenhost", "0.0.0.0:12012", "Listen addr if a server")
+	j.flags.StringVar(&j.sourceHost, "source_host", "localhost", "Source host to get information from, or unix:/path/to/socket")
+	j.flags.StringVar(&j.listenHost, "listenhost", "0.0.0.0:12012", "Listen addr if a server, or unix:/path/to/socket")
 	j.flags.DurationVar(&j.client.Timeout, "timeout", time.Second*30, "Timeout waiting for HTTP responses")
-	j.flags.DurationVar(&j.readyTimeout, "ready_timeout", time.Minute*5, "Timeout waiting for ready signal")
+	j.flags.DurationVar(&j.readyTimeout, "ready_timeout", time.Minute*5, "Timeout waiting for the server, and with -wait_all for the other nodes")
+	j.flags.DurationVar(&j.leaseTimeout, "lease_timeout", 0, "Requeue an item if its node does not heartbeat within this long (0 disables leases)")
+	j.flags.DurationVar(&j.holdTimeout, "hold_timeout", time.Second*20, "How long the server holds a next request while other nodes still lease items")
 	j.flags.IntVar(&j.portNumber, "port", 12012, "Port to use for connections")
+	j.flags.StringVar(&j.reportItem, "item", "", "Item being reported (defaults to the item this node last got)")
+	j.flags.IntVar(&j.reportExitCode, "exit_code", 0, "Exit code of the item being reported")
+	j.flags.DurationVar(&j.reportDuration, "duration", 0, "How long the reported item ran (defaults to the time since it was handed out)")
+	j.flags.StringVar(&j.reportMessage, "message", "", "Optional message to report with the item")
+	j.flags.StringVar(&j.itemEnv, "item_env", "", "If set, exec passes the item in this env var rather than as the last argument; it is always in CIRCLETASKER_ITEM too")
+	j.flags.DurationVar(&j.heartbeatInterval, "heartbeat", 0, "How often exec renews the lease of a running item (defaults to a third of the lease timeout)")
+	j.flags.StringVar(&j.prevResults, "prev_results", "", "Results file of a previous run, used to serve the longest items first")
+	j.flags.StringVar(&j.journal, "journal", filepath.Join(os.Getenv("CIRCLE_ARTIFACTS"), "circletasker.journal"), "File the server journals its state into (empty disables the journal)")
+	j.flags.BoolVar(&j.resume, "resume", false, "Resume serving from the journal of a server that died rather than from stdin")
+	j.flags.BoolVar(&j.failFast, "fail_fast", false, "Stop handing out items once any item is reported as failed")
+	j.flags.IntVar(&j.retries, "retries", 0, "How many times to retry a failed item, preferably on another node")
+	j.flags.IntVar(&j.batch, "batch", 1, "Most items to ask for with each next request")
+	j.flags.DurationVar(&j.batchTarget, "batch_target", 0, "Stop filling a batch once its expected duration from -prev_results reaches this (0 fills batches)")
+	j.flags.StringVar(&j.token, "token", os.Getenv("CIRCLETASKER_TOKEN"), "Shared secret clients must send to the server (empty disables authentication)")
+	j.flags.StringVar(&j.tlsCert, "tls_cert", "", "Certificate the server listens for TLS with")
+	j.flags.StringVar(&j.tlsKey, "tls_key", "", "Key of -tls_cert")
+	j.flags.StringVar(&j.clientCA, "client_ca", "", "If set, the server requires client certificates signed by this CA")
+	j.flags.BoolVar(&j.selfSigned, "self_signed", false, "Listen for TLS with a certificate from an ephemeral CA written to -self_signed_ca")
+	j.flags.StringVar(&j.selfSignedCA, "self_signed_ca", filepath.Join(os.Getenv("CIRCLE_ARTIFACTS"), "circletasker-ca.pem"), "Where -self_signed writes the CA clients pass as -ca")
+	j.flags.StringVar(&j.caFile, "ca", "", "CA the client verifies the server with; connects over TLS if set")
+	j.flags.StringVar(&j.certFile, "cert", "", "Client certificate to present to the server; connects over TLS if set")
+	j.flags.StringVar(&j.keyFile, "key", "", "Key of -cert")
+	j.flags.IntVar(&j.workers, "workers", runtime.NumCPU(), "Number of items local runs at once")
+	j.flags.StringVar(&j.caps, "caps", "", "Comma separated tags this node can run items for")
+	j.flags.DurationVar(&j.itemTimeoutFlag, "item_timeout", 0, "Stop items that run longer than this (0 lets them run)")
+	j.flags.Float64Var(&j.timeoutFactor, "timeout_factor", 0, "If set, stop items that run this many times longer than in -prev_results instead")
+	j.flags.DurationVar(&j.killAfter, "kill_after", time.Second*10, "How long a timed out item has to stop before it is killed")
+	logDir := ""
+	if artifacts := os.Getenv("CIRCLE_ARTIFACTS"); artifacts != "" {
+		logDir = filepath.Join(artifacts, "circletasker")
+	}
+	j.flags.StringVar(&j.logDir, "log_dir", logDir, "Directory exec and local capture the output of each item into, under the node index (empty disables it)")
+	j.flags.Int64Var(&j.logMaxBytes, "log_max_bytes", 10<<20, "Most output captured per item; the rest is only printed")
+	j.flags.DurationVar(&j.reconnectTimeout, "reconnect_timeout", time.Minute*2, "How long next keeps retrying when it cannot reach the server")
+	j.flags.BoolVar(&j.waitAll, "wait_all", false, "Make ready wait until all -node_total nodes are ready")
+	j.flags.DurationVar(&j.joinGrace, "join_grace", time.Minute*10, "How long the server waits for -node_total nodes to join before it stops without them (0 waits forever)")
+	j.flags.DurationVar(&j.drainTimeout, "drain_timeout", time.Second*30, "How long the server keeps answering nodes after SIGTERM or SIGINT, to tell them to stop")
+	j.flags.DurationVar(&j.idleTimeout, "idle_timeout", time.Minute*10, "Release a node that holds no items once it was not heard from for this long (0 waits forever)")
 	j.log = log.New(j.logOut, "[circletasker]", log.LstdFlags)
 	return j.flags.Parse(j.args)
 }
@@ -194,44 +919,150 @@ func main() {
 	if err := mainInstance.main(); err != nil {
 		_, err2 := io.WriteString(os.Stderr, err.Error()+"\n")
 		logIfNotNil(err2, "Unable to write err to stderr")
+		if code, ok := err.(exitCodeError); ok {
+			os.Exit(int(code))
+		}
 		os.Exit(1)
 	}
 }
 
-func (j *circleTasker) next() error {
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d", j.sourceHost, j.portNumber), nil)
-	if err != nil {
-		return err
+func (j *circleTasker) url(path string) string {
+	scheme := "http"
+	if j.usesTLS() {
+		scheme = "https"
 	}
-	req.Header.Add(sourceIndexHeader, strconv.FormatInt(int64(j.nodeIndex), 10))
-	resp, err := j.client.Do(req)
-	if err != nil {
-		return err
+	if strings.HasPrefix(j.sourceHost, unixPrefix) {
+		return fmt.Sprintf("%s://unix%s", scheme, path)
 	}
-	defer func() {
-		logIfNotNil(resp.Body.Close(), "cannot close client response body")
-	}()
-	if resp.StatusCode == http.StatusNoContent {
+	return fmt.Sprintf("%s://%s:%d%s", scheme, j.sourceHost, j.portNumber, path)
+}
+
+// setupClient points the client at a unix socket source host and sets up TLS
+func (j *circleTasker) setupClient() error {
+	socket := strings.TrimPrefix(j.sourceHost, unixPrefix)
+	if socket == j.sourceHost && !j.usesTLS() {
 		return nil
 	}
-	if resp.StatusCode == http.StatusOK {
-		_, err := io.Copy(j.out, resp.Body)
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if socket != j.sourceHost {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	if j.usesTLS() {
+		conf, err := j.clientTLS()
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = conf
+	}
+	j.client.Transport = transport
+	return nil
+}
+
+// listen listens on listenHost, a TCP address or unix: and a socket path.  A socket left at the
+// path by an earlier server is removed, anything else there is an error.
+func listen(listenHost string) (net.Listener, error) {
+	if !strings.HasPrefix(listenHost, unixPrefix) {
+		return net.Listen("tcp", listenHost)
+	}
+	socket := strings.TrimPrefix(listenHost, unixPrefix)
+	fi, err := os.Lstat(socket)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Cannot listen on %s: it exists and is not a socket", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", socket)
+}
+
+func (j *circleTasker) next() error {
+	items, err := j.fetchNext(true)
+	if err != nil || len(items) == 0 {
 		return err
 	}
-	b, err := ioutil.ReadAll(resp.Body)
-	logIfNotNil(err, "Cannot read from response body")
-	j.log.Println(string(b))
-	return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Item)
+	}
+	_, err = io.WriteString(j.out, strings.Join(names, "\n"))
+	return err
 }
 
-func (j *circleTasker) serve() error {
+// fetchNext asks the server for the next batch of items, returning none once this node is done.
+// If finished, the items this node got before ran, whether or not they were reported.  Network
+// errors are retried with the same request ID, so if the server handled a request whose answer got
+// lost, it answers the retry with the same items.
+func (j *circleTasker) fetchNext(finished bool) ([]v1Item, error) {
+	resp, err := j.callRetrying(v1NextPath, v1Request{Index: j.nodeIndex, Batch: j.batch, Caps: splitList(j.caps), Finished: finished})
+	return resp.Items, err
+}
+
+// callRetrying makes the v1 request in to path under a new request ID, so the server answers a
+// retry of a request it already handled the same.  Network errors are retried with backoff for
+// -reconnect_timeout, and a request the server holds is asked again.
+func (j *circleTasker) callRetrying(path string, in v1Request) (v1Response, error) {
+	id, err := newRequestID()
+	if err != nil {
+		return v1Response{}, err
+	}
+	in.RequestID = id
+	deadline := time.Now().Add(j.reconnectTimeout)
+	b := newBackoff()
+	for {
+		resp, err := j.call(path, in)
+		if perr, ok := err.(*protocolError); ok && perr.Code == errHold.Code {
+			j.log.Println("Server is holding items for other nodes, asking again")
+			continue
+		}
+		if _, rejected := err.(*protocolError); err != nil && !rejected && err != errUnauthorized && time.Now().Before(deadline) {
+			j.log.Printf("Cannot reach the server, retrying: %s", err.Error())
+			b.sleepUntil(deadline)
+			continue
+		}
+		return resp, err
+	}
+}
+
+func (j *circleTasker) heartbeat() error {
+	_, err := j.call(v1HeartbeatPath, v1Request{Index: j.nodeIndex})
+	return err
+}
+
+func (j *circleTasker) report() error {
+	_, err := j.sendReport(itemReport{
+		Item:     j.reportItem,
+		ExitCode: j.reportExitCode,
+		Duration: j.reportDuration,
+		Message:  j.reportMessage,
+	})
+	return err
+}
+
+// sendReport reports rep, returning true if the server queued the item again to retry it
+func (j *circleTasker) sendReport(rep itemReport) (bool, error) {
+	resp, err := j.callRetrying(v1ReportPath, v1Request{Index: j.nodeIndex, Report: &rep})
+	return resp.Retrying, err
+}
+
+func (j *circleTasker) readLines() ([]string, error) {
 	j.log.Println("Reading lines from stdin")
 	allLines := make([]string, 0, 100)
 	r := bufio.NewReaderSize(j.readFrom, 20000)
 	for {
 		line, err := r.ReadString('\n')
 		if err != nil && err != io.EOF {
-			return err
+			return nil, err
 		}
 		if line != "" {
 			allLines = append(allLines, line)
@@ -244,58 +1075,214 @@ func (j *circleTasker) serve() error {
 		allLines[idx] = strings.TrimSpace(l)
 	}
 	j.log.Printf("Read %d lines\n", len(allLines))
-	ss := splitServer{
+	return allLines, nil
+}
+
+// newSplitServer returns a server for nodeTotal nodes that has nothing queued yet
+func (j *circleTasker) newSplitServer(nodeTotal int) *splitServer {
+	ss := &splitServer{
 		listenHost:       j.listenHost,
-		partsToServe:     allLines,
 		log:              j.log,
-		maxClientIndex:   j.nodeTotal,
+		nodeTotal:        nodeTotal,
 		haveToldDone:     make(map[int]struct{}),
 		indexIsReady:     make(map[int]struct{}),
 		listening:        j.listening,
-		processStartTime: make(map[int]startTime, j.nodeTotal),
-		processResults:   make(map[string]time.Duration, len(allLines)),
+		processStartTime: make(map[int][]startTime, nodeTotal),
+		processResults:   make(map[string]time.Duration),
+		leaseTimeout:     j.leaseTimeout,
+		holdTimeout:      j.holdTimeout,
+		lostIndexes:      make(map[int]struct{}),
+		outcomes:         make(map[string]itemOutcome),
+		metrics:          newServerMetrics(),
+		failFast:         j.failFast,
+		retries:          j.retries,
+		attempts:         make(map[string][]itemOutcome),
+		batchTarget:      j.batchTarget,
+		token:            j.token,
+		caps:             make(map[int][]string),
+		seen:             make(map[int]time.Time),
+		joinGrace:        j.joinGrace,
+		idleTimeout:      j.idleTimeout,
+		drainTimeout:     j.drainTimeout,
+		lastNext:         make(map[int]lastNext),
+		nextPending:      make(map[int]string),
+		lastReport:       make(map[int]lastReport),
+	}
+	ss.workChanged = sync.NewCond(&ss.mu)
+	return ss
+}
+
+// orderQueue sorts items by priority, and longest first within a priority if there are
+// -prev_results.  Items that already have an order, such as those of a resumed journal, are left as
+// they are.
+func (j *circleTasker) orderQueue(ss *splitServer, items []string, keepOrder bool) error {
+	if j.prevResults != "" {
+		prev, err := loadPrevResults(j.prevResults)
+		if err != nil {
+			return err
+		}
+		ss.expected = expectedDurations(items, prev)
+		if !keepOrder {
+			sortLongestFirst(items, ss.expected)
+		}
+		j.log.Printf("Ordered items using %d previous durations", len(prev))
+	}
+	if !keepOrder {
+		sortByPriority(items, ss.attrs.Priority)
 	}
+	return nil
+}
+
+func (j *circleTasker) writeResults(ss *splitServer) error {
 	writeInto, err := os.Create(j.runRes)
 	if err != nil {
 		return err
 	}
+	err = json.NewEncoder(writeInto).Encode(ss.results())
+	logIfNotNil(writeInto.Close(), "Cannot close/flush results file")
+	return err
+}
+
+func (j *circleTasker) serve() error {
+	ss := j.newSplitServer(j.nodeTotal)
+	tlsConfig, err := j.serverTLS()
+	if err != nil {
+		return err
+	}
+	ss.tlsConfig = tlsConfig
+	events, resumed, err := j.openJournal(ss)
+	if err != nil {
+		return err
+	}
+	if ss.journalFile != nil {
+		defer func() {
+			logIfNotNil(ss.journalFile.Close(), "Cannot close journal")
+		}()
+	}
+	var allLines []string
+	if resumed {
+		allLines = events[0].Items
+		if events[0].Attrs != nil {
+			ss.attrs = *events[0].Attrs
+		}
+		j.log.Printf("Resuming %d items from %d journal events", len(allLines), len(events))
+	} else if allLines, err = j.readLines(); err != nil {
+		return err
+	} else if allLines, ss.attrs, err = parseItems(allLines); err != nil {
+		return err
+	}
+	if err := j.orderQueue(ss, allLines, resumed); err != nil {
+		return err
+	}
+	if resumed {
+		if err := ss.replay(events); err != nil {
+			return err
+		}
+	} else {
+		ss.setQueue(allLines)
+		ss.record(journalEvent{Event: "queue", Items: allLines, Attrs: &ss.attrs})
+	}
+	if _, err := os.Stat(filepath.Dir(j.runRes)); err != nil {
+		return err
+	}
 	defer func() {
-		logIfNotNil(writeInto.Close(), "Cannot close/flush results file")
-	}()
-	defer func() {
-		logIfNotNil(json.NewEncoder(writeInto).Encode(ss.processResults), "Cannot encode JSON process times")
+		logIfNotNil(j.writeResults(ss), "Cannot write results to %s", j.runRes)
 	}()
-	ss.doneWaitGroup.Add(j.nodeTotal)
 	j.log.Println("Starting server")
-	return ss.start()
+	defer stopOnSignal(ss)()
+	if err := ss.start(); err != nil {
+		return err
+	}
+	if err := ss.interruptedError(); err != nil {
+		return err
+	}
+	return ss.unscheduled()
 }
 
+// loadPrevResults reads item durations from a results file written by serve.  Files written before
+// results carried outcomes hold just the item to duration map.
+func loadPrevResults(filename string) (map[string]time.Duration, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var res runResults
+	if err := json.Unmarshal(b, &res); err == nil && res.Durations != nil {
+		return res.Durations, nil
+	}
+	var durations map[string]time.Duration
+	if err := json.Unmarshal(b, &durations); err != nil {
+		return nil, err
+	}
+	return durations, nil
+}
+
+// expectedDurations returns how long each item should take, using the average of prev for items
+// that did not run before
+func expectedDurations(items []string, prev map[string]time.Duration) map[string]time.Duration {
+	var total time.Duration
+	for _, d := range prev {
+		total += d
+	}
+	var average time.Duration
+	if len(prev) != 0 {
+		average = total / time.Duration(len(prev))
+	}
+	ret := make(map[string]time.Duration, len(items))
+	for _, item := range items {
+		if d, exists := prev[item]; exists {
+			ret[item] = d
+		} else {
+			ret[item] = average
+		}
+	}
+	return ret
+}
+
+// sortLongestFirst orders items so the longest expected ones are handed out first
+func sortLongestFirst(items []string, expected map[string]time.Duration) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return expected[items[i]] > expected[items[j]]
+	})
+}
+
+// sortByPriority orders items so higher priorities are handed out first, keeping the order of
+// items with the same priority
+func sortByPriority(items []string, priority map[string]int) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return priority[items[i]] > priority[items[j]]
+	})
+}
+
+// ready checks in with the server, retrying until it is up.  With -wait_all it then waits until
+// every node checked in.
 func (j *circleTasker) ready() error {
-	now := time.Now()
+	deadline := time.Now().Add(j.readyTimeout)
+	b := newBackoff()
+	waitingFor := -1
 	for {
-		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d", j.sourceHost, j.portNumber), nil)
-		if err != nil {
+		resp, err := j.call(v1ReadyPath, v1Request{Index: j.nodeIndex})
+		if _, rejected := err.(*protocolError); rejected || err == errUnauthorized {
 			return err
 		}
-		// 5 minute timeout on client requests
-		req.Header.Add(sourceIndexHeader, strconv.FormatInt(int64(j.nodeIndex), 10))
-		resp, err := j.client.Do(req)
-		if err != nil {
-			if time.Now().Sub(now).Nanoseconds() <= j.readyTimeout.Nanoseconds() {
-				continue
+		missing := missingIndexes(resp.Ready, resp.NodeTotal)
+		if err == nil && (!j.waitAll || len(missing) == 0) {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			if err != nil {
+				return err
 			}
-			return err
+			j.log.Printf("Nodes never arrived: %s", joinIndexes(missing))
+			return fmt.Errorf("Timed out after %s waiting for nodes %s to be ready", j.readyTimeout, joinIndexes(missing))
 		}
-		defer func() {
-			logIfNotNil(resp.Body.Close(), "cannot close client response body")
-		}()
-		if resp.StatusCode == http.StatusOK {
-			return nil
+		if err != nil {
+			j.log.Printf("Server not ready, retrying: %s", err.Error())
+		} else if len(missing) != waitingFor {
+			waitingFor = len(missing)
+			j.log.Printf("Waiting for nodes %s to be ready", joinIndexes(missing))
 		}
-		b, err := ioutil.ReadAll(resp.Body)
-		logIfNotNil(err, "Cannot read from response body")
-		j.log.Println(string(b))
-		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+		b.sleepUntil(deadline)
 	}
 }
 
@@ -303,17 +1290,28 @@ func (j *circleTasker) main() error {
 	if err := j.flagInit(); err != nil {
 		return err
 	}
-	if len(j.flags.Args()) != 1 {
-		fmt.Println(j.flags.Args())
+	if err := j.setupClient(); err != nil {
+		return err
+	}
+	if len(j.flags.Args()) == 0 {
 		return errors.New("Must pass one argument as thing to do")
 	}
 
 	cmd := j.flags.Arg(0)
+	if len(j.flags.Args()) != 1 && cmd != "exec" && cmd != "local" {
+		fmt.Println(j.flags.Args())
+		return errors.New("Must pass one argument as thing to do")
+	}
 
 	cmdMap := map[string]func() error{
-		"serve": j.serve,
-		"next":  j.next,
-		"ready": j.ready,
+		"serve":     j.serve,
+		"next":      j.next,
+		"ready":     j.ready,
+		"heartbeat": j.heartbeat,
+		"report":    j.report,
+		"exec":      j.exec,
+		"status":    j.status,
+		"local":     j.local,
 	}
 
 	f, exists := cmdMap[cmd]
@@ -2,79 +2,1376 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 	done := sync.WaitGroup{}
-	freePort := "15283"
+	socket := "unix:" + filepath.Join(dir, "circletasker.sock")
 	done.Add(1)
 	server := circleTasker{
 		flags:     flag.NewFlagSet(os.Args[0], flag.ExitOnError),
-		args:      []string{"-listenhost", "localhost:" + freePort, "serve"},
+		args:      []string{"-listenhost", socket, "-run_res", filepath.Join(dir, "circletasker.json"), "-journal", filepath.Join(dir, "circletasker.journal"), "serve"},
 		out:       &bytes.Buffer{},
 		readFrom:  strings.NewReader("hello\nworld"),
 		logOut:    &bytes.Buffer{},
 		listening: make(chan struct{}),
 	}
 	go func() {
+		defer done.Done()
 		e1 := server.main()
 		if e1 != nil {
-			t.Fatalf("Unexpected error %s", e1.Error())
+			t.Errorf("Unexpected error %s", e1.Error())
 		}
-		done.Done()
 	}()
 	done.Add(1)
 
 	readyLoop := func() {
 		client := circleTasker{
 			flags:    flag.NewFlagSet(os.Args[0], flag.ExitOnError),
-			args:     []string{"-source_host", "localhost", "-port", freePort, "ready"},
+			args:     []string{"-source_host", socket, "ready"},
 			out:      &bytes.Buffer{},
 			readFrom: &bytes.Buffer{},
 			logOut:   &bytes.Buffer{},
 		}
 		e1 := client.main()
 		if e1 != nil {
-			t.Fatalf("Unexpected error %s", e1.Error())
+			t.Errorf("Unexpected error %s", e1.Error())
 		}
 	}
 
 	readFrom := func() string {
 		client := circleTasker{
 			flags:    flag.NewFlagSet(os.Args[0], flag.ExitOnError),
-			args:     []string{"-source_host", "localhost", "-port", freePort, "next"},
+			args:     []string{"-source_host", socket, "next"},
 			out:      &bytes.Buffer{},
 			readFrom: &bytes.Buffer{},
 			logOut:   &bytes.Buffer{},
 		}
 		e1 := client.main()
 		if e1 != nil {
-			t.Fatalf("Unexpected error %s", e1.Error())
+			t.Errorf("Unexpected error %s", e1.Error())
 		}
 		return client.out.(*bytes.Buffer).String()
 	}
 
 	go func() {
-		readyLoop()
+		defer done.Done()
 		<-server.listening
+		readyLoop()
 		s1 := readFrom()
 		if s1 != "hello" {
-			t.Fatal(s1)
+			t.Error(s1)
 		}
 		s2 := readFrom()
 		if s2 != "world" {
-			t.Fatal(s2)
+			t.Error(s2)
 		}
 		s3 := readFrom()
 		if s3 != "" {
-			t.Fatal(s3)
+			t.Error(s3)
 		}
-		done.Done()
 	}()
 	done.Wait()
 }
+
+func testSplitServer(nodeTotal int, items ...string) *splitServer {
+	j := &circleTasker{log: log.New(ioutil.Discard, "", 0), holdTimeout: time.Millisecond * 50}
+	ss := j.newSplitServer(nodeTotal)
+	ss.partsToServe = items
+	return ss
+}
+
+func testRequest(ss *splitServer, method string, path string, index int) *httptest.ResponseRecorder {
+	return testRequestBody(ss, method, path, index, "")
+}
+
+func testRequestBody(ss *splitServer, method string, path string, index int, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(sourceIndexHeader, strconv.Itoa(index))
+	rw := httptest.NewRecorder()
+	ss.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	ss := testSplitServer(2, "a", "b")
+	ss.leaseTimeout = time.Minute
+	if rw := testRequest(ss, "GET", "/", 0); rw.Body.String() != "a" {
+		t.Fatal(rw.Body.String())
+	}
+	if rw := testRequest(ss, "GET", "/", 1); rw.Body.String() != "b" {
+		t.Fatal(rw.Body.String())
+	}
+	if rw := testRequest(ss, "POST", heartbeatPath, 1); rw.Code != http.StatusOK {
+		t.Fatal(rw.Code)
+	}
+	ss.expireLeases(ss.processStartTime[0][0].renewTime.Add(time.Minute))
+	if len(ss.expiredLeases) != 1 || ss.expiredLeases[0].Item != "a" || ss.expiredLeases[0].Index != 0 {
+		t.Fatal(ss.expiredLeases)
+	}
+	if _, exists := ss.processStartTime[1]; !exists {
+		t.Fatal("renewed lease should not expire")
+	}
+	if rw := testRequest(ss, "GET", "/", 1); rw.Body.String() != "a" {
+		t.Fatal(rw.Body.String())
+	}
+	if rw := testRequest(ss, "GET", "/", 0); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequest(ss, "POST", heartbeatPath, 0); rw.Code != http.StatusConflict {
+		t.Fatal(rw.Code)
+	}
+	if _, exists := ss.processResults["b"]; !exists {
+		t.Fatal(ss.processResults)
+	}
+}
+
+func TestLeaseHold(t *testing.T) {
+	ss := testSplitServer(2, "a")
+	ss.leaseTimeout = time.Minute
+	if rw := testRequest(ss, "GET", "/", 0); rw.Body.String() != "a" {
+		t.Fatal(rw.Body.String())
+	}
+	if rw := testRequest(ss, "GET", "/", 1); rw.Code != http.StatusServiceUnavailable {
+		t.Fatal(rw.Code)
+	}
+	ss.holdTimeout = time.Minute
+	got := make(chan string)
+	go func() {
+		got <- testRequest(ss, "GET", "/", 1).Body.String()
+	}()
+	time.Sleep(time.Millisecond * 10)
+	ss.mu.Lock()
+	ss.expireLeases(time.Now().Add(time.Minute))
+	ss.mu.Unlock()
+	if item := <-got; item != "a" {
+		t.Fatal(item)
+	}
+}
+
+func TestReport(t *testing.T) {
+	ss := testSplitServer(2, "a", "b")
+	testRequest(ss, "GET", "/", 0)
+	testRequest(ss, "GET", "/", 1)
+	if rw := testRequestBody(ss, "POST", reportPath, 1, `{"item":"a","exit_code":1}`); rw.Code != http.StatusConflict {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequestBody(ss, "POST", reportPath, 1, `{"exit_code":2,"duration":5,"message":"broken"}`); rw.Code != http.StatusOK {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequestBody(ss, "POST", reportPath, 0, `{"item":"a"}`); rw.Code != http.StatusOK {
+		t.Fatal(rw.Code)
+	}
+	res := ss.results()
+	if o := res.Outcomes["b"]; o.Passed || o.Index != 1 || o.ExitCode != 2 || o.Message != "broken" || o.Duration != 5 {
+		t.Fatal(o)
+	}
+	if o := res.Outcomes["a"]; !o.Passed || o.Index != 0 {
+		t.Fatal(o)
+	}
+	if res.Durations["b"] != 5 {
+		t.Fatal(res.Durations)
+	}
+}
+
+func testClient(t *testing.T, serverURL string, args ...string) *circleTasker {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &circleTasker{
+		flags:    flag.NewFlagSet(os.Args[0], flag.ContinueOnError),
+		args:     append([]string{"-source_host", u.Hostname(), "-port", u.Port()}, args...),
+		out:      &bytes.Buffer{},
+		readFrom: &bytes.Buffer{},
+		logOut:   &bytes.Buffer{},
+	}
+}
+
+func TestExec(t *testing.T) {
+	ss := testSplitServer(1, "a", "b c")
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	client := testClient(t, hs.URL, "exec", "--", "sh", "-c", `echo "got $1"; [ "$1" != "b c" ] || exit 3`, "sh")
+	err := client.main()
+	if code, ok := err.(exitCodeError); !ok || code != 3 {
+		t.Fatal(err)
+	}
+	out := client.out.(*bytes.Buffer).String()
+	if out != "[a] got a\n[b c] got b c\n" {
+		t.Fatal(out)
+	}
+	res := ss.results()
+	if !res.Outcomes["a"].Passed || res.Outcomes["b c"].ExitCode != 3 {
+		t.Fatal(res.Outcomes)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	p := &prefixWriter{prefix: "> ", out: buf, mu: &sync.Mutex{}}
+	for _, part := range []string{"hel", "lo\nwor", "ld\n", "tail"} {
+		if _, err := p.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "> hello\n> world\n> tail\n" {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestPrevResultsOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacy := filepath.Join(dir, "legacy.json")
+	if err := ioutil.WriteFile(legacy, []byte(`{"a":1,"b":5,"c":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	current := filepath.Join(dir, "current.json")
+	if err := ioutil.WriteFile(current, []byte(`{"durations":{"a":1,"b":5,"c":3}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{legacy, current} {
+		prev, err := loadPrevResults(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items := []string{"a", "new", "b", "c", "other"}
+		expected := expectedDurations(items, prev)
+		sortLongestFirst(items, expected)
+		if strings.Join(items, " ") != "b new c other a" {
+			t.Fatal(items)
+		}
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	journal := &bytes.Buffer{}
+	ss := testSplitServer(3, "a", "b", "c", "d")
+	ss.leaseTimeout = time.Minute
+	ss.journal = json.NewEncoder(journal)
+	ss.record(journalEvent{Event: "queue", Items: ss.partsToServe})
+	testRequest(ss, "HEAD", "/", 0)
+	testRequest(ss, "GET", "/", 0)
+	testRequest(ss, "GET", "/", 1)
+	testRequest(ss, "GET", "/", 2)
+	testRequestBody(ss, "POST", reportPath, 1, `{"exit_code":1}`)
+	ss.expireLease(2, time.Now())
+	testRequest(ss, "GET", "/", 0)
+	// a crash left half of the last line behind
+	journal.WriteString(`{"event":"ser`)
+	written := journal.String()
+
+	events, size, err := readJournal("journal", strings.NewReader(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(strings.LastIndex(written, "\n")+1) {
+		t.Fatal(size, len(written))
+	}
+	resumed := testSplitServer(3)
+	resumed.leaseTimeout = time.Minute
+	if err := resumed.replay(events); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(resumed.partsToServe, " ") != strings.Join(ss.partsToServe, " ") {
+		t.Fatal(resumed.partsToServe, ss.partsToServe)
+	}
+	if len(resumed.processStartTime) != 1 || resumed.processStartTime[0][0].sentItem != ss.processStartTime[0][0].sentItem {
+		t.Fatal(resumed.processStartTime)
+	}
+	if _, told := resumed.haveToldDone[2]; !told {
+		t.Fatal(resumed.haveToldDone)
+	}
+	if _, ready := resumed.indexIsReady[0]; !ready {
+		t.Fatal(resumed.indexIsReady)
+	}
+	if _, exists := resumed.processResults["a"]; !exists || resumed.outcomes["b"].Passed || len(resumed.expiredLeases) != 1 {
+		t.Fatal(resumed.outcomes, resumed.processResults, resumed.expiredLeases)
+	}
+	if rw := testRequest(resumed, "GET", "/", 1); rw.Body.String() != "d" {
+		t.Fatal(rw.Body.String())
+	}
+
+	if _, _, err := readJournal("journal", strings.NewReader(written+"\n{}\n")); err == nil {
+		t.Fatal("expected a corrupt journal to fail")
+	}
+
+	// resuming drops the partial line, so events recorded after it can be resumed from again
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j := &circleTasker{log: log.New(ioutil.Discard, "", 0), journal: filepath.Join(dir, "circletasker.journal"), resume: true}
+	if err := ioutil.WriteFile(j.journal, []byte(written), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		again := testSplitServer(3)
+		events, resumedJournal, err := j.openJournal(again)
+		if err != nil || !resumedJournal {
+			t.Fatal(resumedJournal, err)
+		}
+		if err := again.replay(events); err != nil {
+			t.Fatal(err)
+		}
+		testRequest(again, "HEAD", "/", i+1)
+		logIfNotNil(again.journalFile.Close(), "Cannot close journal")
+	}
+	b, err := ioutil.ReadFile(j.journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _, err = readJournal("journal", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := events[len(events)-1]; last.Event != "ready" || last.Index != 2 || events[len(events)-2].Index != 1 {
+		t.Fatal(string(b))
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ss := testSplitServer(3, "a", "b", "c")
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	testRequest(ss, "HEAD", "/", 1)
+	testRequest(ss, "GET", "/", 1)
+	testRequest(ss, "GET", "/", 0)
+	testRequestBody(ss, "POST", reportPath, 0, `{"exit_code":4}`)
+	testRequest(ss, "GET", "/", 2)
+	testRequest(ss, "GET", "/", 2)
+
+	st := ss.status(time.Now())
+	if strings.Join(st.Remaining, " ") != "" || len(st.Running) != 1 || st.Running[0].Item != "a" || st.Running[0].Index != 1 {
+		t.Fatal(st)
+	}
+	if len(st.Completed) != 2 || st.Completed[0].Item != "b" || st.Completed[0].Outcome.ExitCode != 4 || st.Completed[1].Outcome != nil {
+		t.Fatal(st.Completed)
+	}
+	if joinIndexes(st.Done) != "2" || joinIndexes(st.Ready) != "1" {
+		t.Fatal(st.Done, st.Ready)
+	}
+
+	client := testClient(t, hs.URL, "status")
+	if err := client.main(); err != nil {
+		t.Fatal(err)
+	}
+	out := client.out.(*bytes.Buffer).String()
+	for _, want := range []string{"Running (1)\n  1  a", "Done nodes:   2", "node 0 exit 4"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("%q not in %s", want, out)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ss := testSplitServer(2, "a", "b", "c")
+	testRequest(ss, "GET", "/", 0)
+	testRequest(ss, "GET", "/", 1)
+	testRequestBody(ss, "POST", reportPath, 1, `{"exit_code":1,"duration":2000000000}`)
+	testRequest(ss, "GET", "/", -1)
+	testRequest(ss, "HEAD", "/", 1)
+	testRequest(ss, "HEAD", "/", 1)
+	rw := testRequest(ss, "GET", metricsPath, 0)
+	for _, want := range []string{
+		"circletasker_items_served_total 2\n",
+		`circletasker_items_completed_total{result="failed"} 1` + "\n",
+		`circletasker_item_duration_seconds_bucket{le="1"} 0` + "\n",
+		`circletasker_item_duration_seconds_bucket{le="5"} 1` + "\n",
+		"circletasker_item_duration_seconds_sum 2\n",
+		"circletasker_queue_depth 1\n",
+		`circletasker_items_in_flight{index="0"} 1` + "\n",
+		`circletasker_items_in_flight{index="1"} 0` + "\n",
+		`circletasker_protocol_errors_total{reason="invalid_index"} 1` + "\n",
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Fatalf("%q not in %s", want, rw.Body.String())
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	ss := testSplitServer(2, "a", "b", "c", "d")
+	ss.failFast = true
+	testRequest(ss, "GET", "/", 0)
+	testRequest(ss, "GET", "/", 1)
+	testRequestBody(ss, "POST", reportPath, 0, `{"exit_code":0}`)
+	if rw := testRequest(ss, "GET", "/", 0); rw.Body.String() != "c" {
+		t.Fatal(rw.Body.String())
+	}
+	testRequestBody(ss, "POST", reportPath, 1, `{"exit_code":1}`)
+	if rw := testRequest(ss, "GET", "/", 1); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequest(ss, "GET", "/", 0); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	res := ss.results()
+	if strings.Join(res.Skipped, " ") != "d" || res.Outcomes["b"].Passed {
+		t.Fatal(res)
+	}
+	if _, exists := res.Durations["c"]; !exists {
+		t.Fatal(res.Durations)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ss := testSplitServer(2, "a", "b", "c")
+	ss.retries = 2
+	ss.failFast = true
+	testRequest(ss, "GET", "/", 0)
+	testRequest(ss, "GET", "/", 1)
+	testRequestBody(ss, "POST", reportPath, 0, `{"exit_code":1}`)
+	// a failed on 0, so 0 gets c even though a is queued first
+	ss.partsToServe = []string{"a", "c"}
+	if rw := testRequest(ss, "GET", "/", 0); rw.Body.String() != "c" {
+		t.Fatal(rw.Body.String())
+	}
+	testRequestBody(ss, "POST", reportPath, 1, `{"exit_code":0}`)
+	if rw := testRequest(ss, "GET", "/", 1); rw.Body.String() != "a" {
+		t.Fatal(rw.Body.String())
+	}
+	testRequestBody(ss, "POST", reportPath, 1, `{"exit_code":0}`)
+	testRequestBody(ss, "POST", reportPath, 0, `{"exit_code":1}`)
+	for i := 0; i < 2; i++ {
+		if rw := testRequest(ss, "GET", "/", 0); rw.Body.String() != "c" {
+			t.Fatal(rw.Body.String())
+		}
+		testRequestBody(ss, "POST", reportPath, 0, `{"exit_code":1}`)
+	}
+	if ss.draining != true || len(ss.partsToServe) != 0 {
+		t.Fatal("c should have used up its retries", ss.partsToServe)
+	}
+	res := ss.results()
+	if strings.Join(res.Flaky, " ") != "a" || len(res.Attempts["c"]) != 3 || res.Outcomes["c"].Attempt != 3 {
+		t.Fatal(res)
+	}
+	if a := res.Attempts["a"]; a[0].Index != 0 || a[0].Passed || a[1].Index != 1 || !a[1].Passed {
+		t.Fatal(a)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ss := testSplitServer(2, "a", "b", "c", "d", "e", "f", "g")
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	client := testClient(t, hs.URL, "-batch", "3", "next")
+	if err := client.main(); err != nil {
+		t.Fatal(err)
+	}
+	if out := client.out.(*bytes.Buffer).String(); out != "a\nb\nc" {
+		t.Fatal(out)
+	}
+	if len(ss.processStartTime[0]) != 3 {
+		t.Fatal(ss.processStartTime)
+	}
+	if rw := testRequestBody(ss, "POST", reportPath, 0, `{"item":"b","exit_code":0}`); rw.Code != http.StatusOK {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequestBody(ss, "POST", reportPath, 0, `{"exit_code":0}`); rw.Code != http.StatusConflict {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequest(ss, "GET", "/", 0); rw.Body.String() != "d" {
+		t.Fatal(rw.Body.String())
+	}
+	for _, item := range []string{"a", "b", "c"} {
+		if _, exists := ss.processResults[item]; !exists {
+			t.Fatal(item, ss.processResults)
+		}
+	}
+
+	ss.batchTarget = time.Minute
+	ss.expected = map[string]time.Duration{"e": time.Second * 40, "f": time.Second * 30, "g": time.Second * 10}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(sourceIndexHeader, "1")
+	req.Header.Set(batchHeader, "5")
+	rw := httptest.NewRecorder()
+	ss.ServeHTTP(rw, req)
+	if rw.Body.String() != "e\nf" {
+		t.Fatal(rw.Body.String())
+	}
+}
+
+func TestV1Protocol(t *testing.T) {
+	ss := testSplitServer(2)
+	ss.setQueue([]string{"a", "b"})
+	ss.leaseTimeout = time.Minute
+	call := func(path string, body string) (int, v1Response) {
+		rw := testRequestBody(ss, "POST", path, 0, body)
+		var resp v1Response
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return rw.Code, resp
+	}
+	if code, resp := call(v1ReadyPath, `{"index":1}`); code != http.StatusOK || resp.Error != nil {
+		t.Fatal(code, resp)
+	}
+	code, resp := call(v1NextPath, `{"index":1,"batch":2}`)
+	if code != http.StatusOK || len(resp.Items) != 2 || resp.Done {
+		t.Fatal(code, resp)
+	}
+	if v := resp.Items[1]; v.ID != "2" || v.Item != "b" || v.Attempt != 1 || v.Lease == nil || v.Lease.Timeout != time.Minute {
+		t.Fatal(v)
+	}
+	if code, resp := call(v1ReportPath, `{"index":1,"report":{"item":"c"}}`); code != http.StatusConflict || resp.Error.Code != "no_lease" {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1ReportPath, `{"index":1,"report":{"item":"a","exit_code":1}}`); code != http.StatusOK || resp.Error != nil {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1HeartbeatPath, `{"index":1}`); code != http.StatusOK || resp.Error != nil {
+		t.Fatal(code, resp)
+	}
+	// b was never reported, so it is handed out again rather than counted as passed
+	if code, resp := call(v1NextPath, `{"index":1}`); code != http.StatusOK || len(resp.Items) != 1 || resp.Items[0].Item != "b" {
+		t.Fatal(code, resp)
+	}
+	if _, finished := ss.processResults["b"]; finished {
+		t.Fatal(ss.processResults)
+	}
+	if code, resp := call(v1ReportPath, `{"index":1,"report":{"item":"b"}}`); code != http.StatusOK || resp.Error != nil {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1NextPath, `{"index":1}`); code != http.StatusOK || !resp.Done {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1NextPath, `{"index":1}`); code != http.StatusBadRequest || resp.Error.Code != "duplicate_done" {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1NextPath, `{"index":-1}`); code != http.StatusBadRequest || resp.Error.Code != "invalid_index" {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call("/v1/nope", `{"index":0}`); code != http.StatusNotFound || resp.Error.Code != "unknown_path" {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1NextPath, `not json`); code != http.StatusBadRequest || resp.Error.Code != "invalid_request" {
+		t.Fatal(code, resp)
+	}
+	if ss.outcomes["a"].Passed {
+		t.Fatal(ss.outcomes)
+	}
+}
+
+func TestToken(t *testing.T) {
+	ss := testSplitServer(1, "a")
+	ss.token = "secret"
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	if rw := testRequest(ss, "GET", "/", 0); rw.Code != http.StatusUnauthorized {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequest(ss, "GET", statusPath, 0); rw.Code != http.StatusUnauthorized {
+		t.Fatal(rw.Code)
+	}
+	var resp v1Response
+	rw := testRequestBody(ss, "POST", v1NextPath, 0, `{"index":0}`)
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || rw.Code != http.StatusUnauthorized || resp.Error.Code != "unauthorized" {
+		t.Fatal(rw.Code, err, resp)
+	}
+	wrong := testClient(t, hs.URL, "-token", "guess", "next")
+	if err := wrong.main(); err == nil {
+		t.Fatal("expected the wrong token to be rejected")
+	}
+	// ready gives up on the wrong token rather than waiting for the server to be up
+	wrongReady := testClient(t, hs.URL, "-token", "guess", "ready")
+	if err := wrongReady.main(); err != errUnauthorized {
+		t.Fatal(err)
+	}
+	right := testClient(t, hs.URL, "-token", "secret", "next")
+	if err := right.main(); err != nil {
+		t.Fatal(err)
+	}
+	if out := right.out.(*bytes.Buffer).String(); out != "a" {
+		t.Fatal(out)
+	}
+	if ss.metrics.protocolErrors["unauthorized"] != 5 {
+		t.Fatal(ss.metrics.protocolErrors)
+	}
+}
+
+func writeTestCert(t *testing.T, dir string, name string, cert tls.Certificate) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clientCA, clientCAKey, err := newCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAFile := filepath.Join(dir, "client-ca.pem")
+	if err := ioutil.WriteFile(clientCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCA.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := issueCert(clientCA, clientCAKey, []string{"node1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeTestCert(t, dir, "client", clientCert)
+
+	serverCA := filepath.Join(dir, "ca.pem")
+	server := circleTasker{
+		flags:  flag.NewFlagSet(os.Args[0], flag.ContinueOnError),
+		args:   []string{"-self_signed", "-self_signed_ca", serverCA, "-client_ca", clientCAFile, "serve"},
+		logOut: &bytes.Buffer{},
+	}
+	if err := server.flagInit(); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := server.serverTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := testSplitServer(1, "a")
+	hs := httptest.NewUnstartedServer(ss)
+	hs.TLS = conf
+	hs.StartTLS()
+	defer hs.Close()
+
+	anonymous := testClient(t, hs.URL, "-ca", serverCA, "-reconnect_timeout", "0", "next")
+	if err := anonymous.main(); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+	client := testClient(t, hs.URL, "-ca", serverCA, "-cert", certFile, "-key", keyFile, "next")
+	if err := client.main(); err != nil {
+		t.Fatal(err)
+	}
+	if out := client.out.(*bytes.Buffer).String(); out != "a" {
+		t.Fatal(out)
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "results.json")
+	if err := ioutil.WriteFile(file, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix + file); err == nil {
+		t.Fatal("listening should not replace a file that is not a socket")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "circletasker.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	logIfNotNil(stale.Close(), "Cannot close stale listener")
+	l, err := listen(unixPrefix + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logIfNotNil(l.Close(), "Cannot close listener")
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runRes := filepath.Join(dir, "circletasker.json")
+	j := circleTasker{
+		flags:    flag.NewFlagSet(os.Args[0], flag.ContinueOnError),
+		args:     []string{"-workers", "2", "-run_res", runRes, "local", "--", "sh", "-c", `echo "got $1"; [ "$1" != "c" ] || exit 3`, "sh"},
+		out:      &bytes.Buffer{},
+		readFrom: strings.NewReader("a\nb\nc\nd\n"),
+		logOut:   &bytes.Buffer{},
+	}
+	err = j.main()
+	if code, ok := err.(exitCodeError); !ok || code != 3 {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(j.out.(*bytes.Buffer).String()), "\n")
+	if len(lines) != 4 {
+		t.Fatal(lines)
+	}
+	b, err := ioutil.ReadFile(runRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res runResults
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Durations) != 4 || res.Outcomes["c"].ExitCode != 3 || !res.Outcomes["a"].Passed {
+		t.Fatal(string(b))
+	}
+}
+
+func TestLocalRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runRes := filepath.Join(dir, "circletasker.json")
+	j := circleTasker{
+		flags:    flag.NewFlagSet(os.Args[0], flag.ContinueOnError),
+		args:     []string{"-workers", "1", "-retries", "1", "-run_res", runRes, "local", "--", "sh", "-c", `[ "$1" != a ] || [ "$CIRCLETASKER_ATTEMPT" != 1 ]`, "sh"},
+		out:      &bytes.Buffer{},
+		readFrom: strings.NewReader("a\nb\n"),
+		logOut:   &bytes.Buffer{},
+	}
+	// a fails once and passes on its retry, so the run passes
+	if err := j.main(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(runRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res runResults
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Flaky, " ") != "a" || !res.Outcomes["a"].Passed {
+		t.Fatal(string(b))
+	}
+}
+
+func TestTags(t *testing.T) {
+	items, attrs, err := parseItems([]string{"a", "b\ttags=docker, linux", "c\ttags=gpu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(items, " ") != "a b c" || strings.Join(attrs.Tags["b"], " ") != "docker linux" || len(attrs.Tags["a"]) != 0 {
+		t.Fatal(items, attrs)
+	}
+	if _, _, err := parseItems([]string{"a\tcolor=red"}); err == nil {
+		t.Fatal("unknown attributes should be rejected")
+	}
+	ss := testSplitServer(2)
+	ss.attrs = attrs
+	ss.setQueue(items)
+	next := func(body string) v1Response {
+		var resp v1Response
+		if err := json.NewDecoder(testRequestBody(ss, "POST", v1NextPath, 0, body).Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := next(`{"index":0,"batch":3}`); len(resp.Items) != 1 || resp.Items[0].Item != "a" {
+		t.Fatal(resp)
+	}
+	if resp := next(`{"index":1,"batch":3,"caps":["linux","docker"]}`); len(resp.Items) != 1 || resp.Items[0].Item != "b" {
+		t.Fatal(resp)
+	}
+	if resp := next(`{"index":0,"finished":true}`); !resp.Done {
+		t.Fatal(resp)
+	}
+	if resp := next(`{"index":1,"caps":["linux","docker"],"finished":true}`); !resp.Done {
+		t.Fatal(resp)
+	}
+	if err := ss.unscheduled(); err == nil || !strings.Contains(err.Error(), "c (gpu)") {
+		t.Fatal(err)
+	}
+	if res := ss.results(); strings.Join(res.Unscheduled, " ") != "c" {
+		t.Fatal(res.Unscheduled)
+	}
+}
+
+func TestDAG(t *testing.T) {
+	items, attrs, err := parseItems([]string{
+		`{"id":"build","cmd":"make image"}`,
+		`{"id":"test","cmd":"test image","after":["build"]}`,
+		`{"id":"push","cmd":"push image","after":["test"]}`,
+		"lint",
+		`{"id":"docs","after":["lint"]}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(attrs.After["push image"], " ") != "test image" || strings.Join(attrs.After["docs"], " ") != "lint" {
+		t.Fatal(attrs.After)
+	}
+	if _, _, err := parseItems([]string{`{"id":"a","after":["c"]}`, `{"id":"b","after":["a"]}`, `{"id":"c","after":["b"]}`}); err == nil || !strings.Contains(err.Error(), "a -> c -> b -> a") {
+		t.Fatal(err)
+	}
+	if _, _, err := parseItems([]string{`{"id":"a","after":["nope"]}`}); err == nil {
+		t.Fatal("unknown dependencies should be rejected")
+	}
+	if _, _, err := parseItems([]string{`{"cmd":"make"}`, `{"cmd":"make"}`}); err == nil {
+		t.Fatal("duplicate items should be rejected")
+	}
+	if _, _, err := parseItems([]string{`{"id":"a","cmd":"make"}`, `{"id":"a","cmd":"test"}`}); err == nil || !strings.Contains(err.Error(), "share id a") {
+		t.Fatal(err)
+	}
+	ss := testSplitServer(2)
+	ss.attrs = attrs
+	ss.setQueue(items)
+	call := func(path string, body string) (int, v1Response) {
+		rw := testRequestBody(ss, "POST", path, 0, body)
+		var resp v1Response
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return rw.Code, resp
+	}
+	code, resp := call(v1NextPath, `{"index":0,"batch":5}`)
+	if len(resp.Items) != 2 || resp.Items[0].Item != "make image" || resp.Items[0].ID != "build" || resp.Items[1].Item != "lint" {
+		t.Fatal(code, resp)
+	}
+	if code, resp := call(v1NextPath, `{"index":1}`); code != http.StatusServiceUnavailable || resp.Error.Code != "retry" {
+		t.Fatal(code, resp)
+	}
+	call(v1ReportPath, `{"index":0,"report":{"item":"make image","exit_code":1}}`)
+	call(v1ReportPath, `{"index":0,"report":{"item":"lint"}}`)
+	if _, resp := call(v1NextPath, `{"index":1,"batch":5}`); len(resp.Items) != 1 || resp.Items[0].Item != "docs" {
+		t.Fatal(resp)
+	}
+	if res := ss.results(); strings.Join(res.Skipped, " ") != "test image push image" || len(res.Unscheduled) != 0 {
+		t.Fatal(res)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prev := filepath.Join(dir, "prev.json")
+	if err := ioutil.WriteFile(prev, []byte(`{"durations":{"a":1,"b":5,"c":3,"smoke1":1,"smoke2":7,"late":9}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{"a", "smoke1\tpriority=10", "b", "c", "smoke2\tpriority=10", `{"id":"late","priority":-1}`}
+	for prevResults, want := range map[string]string{
+		"":   "smoke1 smoke2 a b c late",
+		prev: "smoke2 smoke1 b c a late",
+	} {
+		items, attrs, err := parseItems(lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := &circleTasker{prevResults: prevResults, log: log.New(ioutil.Discard, "", 0)}
+		ss := testSplitServer(1)
+		ss.attrs = attrs
+		if err := j.orderQueue(ss, items, false); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(items, " ") != want {
+			t.Fatal(items)
+		}
+	}
+	if _, _, err := parseItems([]string{"a\tpriority=high"}); err == nil {
+		t.Fatal("priorities must be numbers")
+	}
+}
+
+func TestMembership(t *testing.T) {
+	ss := testSplitServer(2, "a")
+	ss.idleTimeout = time.Minute
+	now := time.Now()
+	if ss.finished(now) {
+		t.Fatal("finished before any node joined")
+	}
+	testRequest(ss, "HEAD", "/", 5)
+	if rw := testRequest(ss, "GET", "/", 5); rw.Body.String() != "a" {
+		t.Fatal(rw.Code, rw.Body.String())
+	}
+	testRequest(ss, "HEAD", "/", 0)
+	// without leases only the idle node is released, not the one running a
+	ss.expireLeases(time.Now().Add(ss.idleTimeout + ss.holdTimeout))
+	if _, lost := ss.lostIndexes[0]; !lost || len(ss.lostIndexes) != 1 {
+		t.Fatal(ss.lostIndexes)
+	}
+	testRequestBody(ss, "POST", reportPath, 5, `{}`)
+	if ss.finished(time.Now()) {
+		t.Fatal("finished before index 5 was released")
+	}
+	if rw := testRequest(ss, "GET", "/", 5); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	if !ss.finished(time.Now()) {
+		t.Fatal("not finished once every node was released")
+	}
+
+	late := testSplitServer(3, "a")
+	late.joinGrace = time.Millisecond * 20
+	finished := make(chan struct{})
+	go func() {
+		late.waitFinished()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 5):
+		t.Fatal("still waiting for nodes after the join grace period")
+	}
+	if err := late.unscheduled(); err == nil {
+		t.Fatal("items nobody ran should be reported")
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ss := testSplitServer(2, "a", "b", "c")
+	ss.listenHost = "unix:" + filepath.Join(dir, "circletasker.sock")
+	ss.listening = make(chan struct{})
+	ss.drainTimeout = time.Millisecond * 20
+	started := make(chan error, 1)
+	go func() {
+		started <- ss.start()
+	}()
+	<-ss.listening
+	testRequest(ss, "HEAD", "/", 0)
+	testRequest(ss, "HEAD", "/", 1)
+	testRequest(ss, "GET", "/", 0)
+	ss.interrupt("terminated")
+	// neither node asks again, so the server stops once the drain timeout passes
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server did not stop")
+	}
+	if rw := testRequest(ss, "GET", "/", 1); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	res := ss.results()
+	if res.Interrupted != "terminated" || strings.Join(res.InFlight, " ") != "a" || strings.Join(res.NotStarted, " ") != "b c" || len(res.Unscheduled) != 0 {
+		t.Fatal(res)
+	}
+	if ss.interruptedError() == nil {
+		t.Fatal("an interrupted server should fail")
+	}
+
+	drained := testSplitServer(2, "a", "b")
+	drained.listenHost = "unix:" + filepath.Join(dir, "drained.sock")
+	drained.listening = make(chan struct{})
+	drained.drainTimeout = time.Minute
+	go func() {
+		started <- drained.start()
+	}()
+	<-drained.listening
+	testRequest(drained, "HEAD", "/", 0)
+	testRequest(drained, "HEAD", "/", 1)
+	testRequest(drained, "GET", "/", 0)
+	drained.interrupt("terminated")
+	if rw := testRequest(drained, "GET", "/", 1); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequestBody(drained, "POST", reportPath, 0, `{"exit_code":0}`); rw.Code != http.StatusOK {
+		t.Fatal(rw.Code)
+	}
+	if rw := testRequest(drained, "GET", "/", 0); rw.Code != http.StatusNoContent {
+		t.Fatal(rw.Code)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server did not stop once every node was told to stop")
+	}
+	if res := drained.results(); len(res.InFlight) != 0 || !res.Outcomes["a"].Passed || strings.Join(res.NotStarted, " ") != "b" {
+		t.Fatal(res)
+	}
+}
+
+func TestReadyBarrier(t *testing.T) {
+	ss := testSplitServer(2, "a")
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	waiting := testClient(t, hs.URL, "-node_index", "0", "-wait_all", "ready")
+	ready := make(chan error, 1)
+	go func() {
+		ready <- waiting.main()
+	}()
+	time.Sleep(time.Millisecond * 50)
+	for i := 0; i < 2; i++ {
+		if err := testClient(t, hs.URL, "-node_index", "1", "ready").main(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-ready:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("ready -wait_all did not return once every node was ready")
+	}
+
+	lonely := testSplitServer(3)
+	ls := httptest.NewServer(lonely)
+	defer ls.Close()
+	client := testClient(t, ls.URL, "-node_index", "1", "-wait_all", "-ready_timeout", "300ms", "ready")
+	if err := client.main(); err == nil || !strings.Contains(err.Error(), "nodes 0 2 ") {
+		t.Fatal(err)
+	}
+	if !strings.Contains(client.logOut.(*bytes.Buffer).String(), "Nodes never arrived: 0 2") {
+		t.Fatal(client.logOut)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Millisecond, max: time.Millisecond * 8}
+	for i, upper := range []time.Duration{1, 2, 4, 8, 8} {
+		upper *= time.Millisecond
+		if d := b.next(); d < upper/2 || d > upper {
+			t.Fatal(i, d)
+		}
+	}
+}
+
+func TestNextRetry(t *testing.T) {
+	ss := testSplitServer(1, "a", "b", "c")
+	next := func(body string) v1Response {
+		var resp v1Response
+		if err := json.NewDecoder(testRequestBody(ss, "POST", v1NextPath, 0, body).Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, body := range []string{`{"index":0,"request_id":"x"}`, `{"index":0,"request_id":"x"}`} {
+		if resp := next(body); len(resp.Items) != 1 || resp.Items[0].Item != "a" {
+			t.Fatal(resp)
+		}
+	}
+	if resp := next(`{"index":0,"request_id":"y","finished":true}`); len(resp.Items) != 1 || resp.Items[0].Item != "b" {
+		t.Fatal(resp)
+	}
+
+	var mu sync.Mutex
+	dropped := false
+	hs := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		drop := !dropped
+		dropped = true
+		mu.Unlock()
+		if !drop {
+			ss.ServeHTTP(rw, req)
+			return
+		}
+		// the server hands out the item but the node never hears back
+		ss.ServeHTTP(httptest.NewRecorder(), req)
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		logIfNotNil(conn.Close(), "Cannot close hijacked connection")
+	}))
+	defer hs.Close()
+	client := testClient(t, hs.URL, "next")
+	if err := client.main(); err != nil {
+		t.Fatal(err)
+	}
+	if out := client.out.(*bytes.Buffer).String(); out != "c" {
+		t.Fatal(out)
+	}
+	if len(ss.partsToServe) != 0 || ss.metrics.itemsServed != 3 {
+		t.Fatal(ss.partsToServe, ss.metrics.itemsServed)
+	}
+
+	// a resumed server answers the retry the same, rather than counting a as finished
+	journal := &bytes.Buffer{}
+	crashed := testSplitServer(1, "a", "b")
+	crashed.journal = json.NewEncoder(journal)
+	crashed.record(journalEvent{Event: "queue", Items: crashed.partsToServe})
+	testRequestBody(crashed, "POST", v1NextPath, 0, `{"index":0,"request_id":"x"}`)
+	events, _, err := readJournal("journal", journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss = testSplitServer(1)
+	if err := ss.replay(events); err != nil {
+		t.Fatal(err)
+	}
+	if resp := next(`{"index":0,"request_id":"x"}`); len(resp.Items) != 1 || resp.Items[0].Item != "a" {
+		t.Fatal(resp)
+	}
+	if _, finished := ss.processResults["a"]; finished || strings.Join(ss.partsToServe, " ") != "b" {
+		t.Fatal(ss.processResults, ss.partsToServe)
+	}
+
+	// a retry that arrives while the server still holds the request waits for its answer
+	ss.nextPending[0] = "y"
+	retried := make(chan v1Response, 1)
+	go func() {
+		var resp v1Response
+		logIfNotNil(json.NewDecoder(testRequestBody(ss, "POST", v1NextPath, 0, `{"index":0,"request_id":"y"}`).Body).Decode(&resp), "Cannot decode response")
+		retried <- resp
+	}()
+	time.Sleep(time.Millisecond * 20)
+	ss.mu.Lock()
+	ss.handOut(0, "b", time.Now(), "y", true)
+	delete(ss.nextPending, 0)
+	ss.workChanged.Broadcast()
+	ss.mu.Unlock()
+	if resp := <-retried; len(resp.Items) != 1 || resp.Items[0].Item != "b" || ss.metrics.itemsServed != 2 {
+		t.Fatal(resp, ss.metrics.itemsServed)
+	}
+}
+
+func TestReportRetry(t *testing.T) {
+	ss := testSplitServer(1, "a", "b")
+	ss.retries = 1
+	var mu sync.Mutex
+	dropped := false
+	hs := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		drop := !dropped && req.URL.Path == v1ReportPath
+		dropped = dropped || drop
+		mu.Unlock()
+		if !drop {
+			ss.ServeHTTP(rw, req)
+			return
+		}
+		// the server records the report but the node never hears back
+		ss.ServeHTTP(httptest.NewRecorder(), req)
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		logIfNotNil(conn.Close(), "Cannot close hijacked connection")
+	}))
+	defer hs.Close()
+	client := testClient(t, hs.URL, "exec", "--", "sh", "-c", `[ "$1" != a ] || exit 2`, "sh")
+	// the retried report is answered as recorded, so the first failure of a is still retried
+	err := client.main()
+	if code, ok := err.(exitCodeError); !ok || code != 2 {
+		t.Fatal(err)
+	}
+	if len(ss.attempts["a"]) != 2 || len(ss.attempts["b"]) != 1 || !ss.outcomes["b"].Passed {
+		t.Fatal(ss.attempts)
+	}
+}
+
+func TestItemEnviron(t *testing.T) {
+	ss := testSplitServer(3)
+	ss.setQueue([]string{"a", "b"})
+	ss.expected = map[string]time.Duration{"b": time.Millisecond * 1500}
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	client := testClient(t, hs.URL, "-node_index", "2", "-item_env", "ITEM", "exec", "--", "sh", "-c", `echo "$ITEM $CIRCLETASKER_ITEM $CIRCLETASKER_ITEM_ID $CIRCLETASKER_ATTEMPT $CIRCLETASKER_NODE_INDEX $CIRCLETASKER_EXPECTED_DURATION" $#`)
+	if err := client.main(); err != nil {
+		t.Fatal(err)
+	}
+	if out := client.out.(*bytes.Buffer).String(); out != "[a] a a 1 1 2  0\n[b] b b 2 1 2 1.5 0\n" {
+		t.Fatal(out)
+	}
+}
+
+func TestItemTimeout(t *testing.T) {
+	j := &circleTasker{itemTimeoutFlag: time.Minute, timeoutFactor: 3}
+	for v, want := range map[v1Item]time.Duration{
+		{Item: "own", Timeout: time.Second, Expected: time.Second}: time.Second,
+		{Item: "known", Expected: time.Second}:                     time.Second * 3,
+		{Item: "new"}:                                              time.Minute,
+	} {
+		if got := j.itemTimeout(v); got != want {
+			t.Fatal(v, got)
+		}
+	}
+
+	ss := testSplitServer(1)
+	ss.attrs.Timeout = map[string]time.Duration{"b": time.Second * 10}
+	ss.setQueue([]string{"a", "b"})
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	start := time.Now()
+	client := testClient(t, hs.URL, "-item_timeout", "200ms", "-kill_after", "5s", "exec", "--", "sh", "-c", `if [ "$1" = b ]; then sleep 0.5; exit 0; fi; sleep 10 & wait`, "sh")
+	if err := client.main(); err != exitCodeError(timeoutExitCode) {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second*4 {
+		t.Fatalf("took %s, the process group should have stopped on SIGTERM", took)
+	}
+	res := ss.results()
+	if o := res.Outcomes["a"]; !o.TimedOut || o.ExitCode != timeoutExitCode || o.Passed {
+		t.Fatal(o)
+	}
+	if o := res.Outcomes["b"]; !o.Passed {
+		t.Fatal(o)
+	}
+
+	stubborn := testSplitServer(1, "c")
+	ss2 := httptest.NewServer(stubborn)
+	defer ss2.Close()
+	start = time.Now()
+	client = testClient(t, ss2.URL, "-item_timeout", "100ms", "-kill_after", "100ms", "exec", "--", "sh", "-c", `trap "" TERM; sleep 10`, "sh")
+	if err := client.main(); err != exitCodeError(timeoutExitCode) {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second*4 {
+		t.Fatalf("took %s, the process group should have been killed", took)
+	}
+}
+
+// stoppingQueue hands out its items in one batch, and stops j once the first is reported
+type stoppingQueue struct {
+	j        *circleTasker
+	items    []v1Item
+	reported []string
+}
+
+func (q *stoppingQueue) node() int {
+	return 0
+}
+
+func (q *stoppingQueue) next() ([]v1Item, error) {
+	items := q.items
+	q.items = nil
+	return items, nil
+}
+
+func (q *stoppingQueue) heartbeat() error {
+	return nil
+}
+
+func (q *stoppingQueue) report(rep itemReport) (bool, error) {
+	q.reported = append(q.reported, rep.Item)
+	if len(q.reported) == 1 {
+		q.j.stopItems(syscall.SIGTERM)
+	}
+	return false, nil
+}
+
+func TestStopItems(t *testing.T) {
+	j := &circleTasker{log: log.New(ioutil.Discard, "", 0), killAfter: time.Second * 5, itemsStopped: make(chan struct{})}
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	setProcessGroup(cmd)
+	time.AfterFunc(time.Millisecond*100, func() {
+		j.stopItems(syscall.SIGTERM)
+	})
+	start := time.Now()
+	if timedOut, err := j.run(cmd, 0); timedOut || err == nil {
+		t.Fatal(timedOut, err)
+	}
+	if took := time.Since(start); took > time.Second*4 {
+		t.Fatalf("took %s, the process group should have stopped on SIGTERM", took)
+	}
+	if _, err := j.work(localQueue{}, []string{"true"}); err == nil || !strings.Contains(err.Error(), "terminated") {
+		t.Fatal(err)
+	}
+
+	// a stop during a batch leaves the rest of it unstarted and unreported
+	j = &circleTasker{log: log.New(ioutil.Discard, "", 0), out: &bytes.Buffer{}, logOut: &bytes.Buffer{}, itemsStopped: make(chan struct{})}
+	q := &stoppingQueue{j: j, items: []v1Item{{Item: "a"}, {Item: "b"}, {Item: "c"}}}
+	if _, err := j.work(q, []string{"sh", "-c", `echo "ran $1"`, "sh"}); err == nil || !strings.Contains(err.Error(), "terminated") {
+		t.Fatal(err)
+	}
+	if out := j.out.(*bytes.Buffer).String(); strings.Join(q.reported, " ") != "a" || out != "[a] ran a\n" {
+		t.Fatal(q.reported, out)
+	}
+
+	// the item exits, but what it started in the background holds on to its output
+	j = &circleTasker{log: log.New(ioutil.Discard, "", 0), killAfter: time.Millisecond * 100}
+	cmd = exec.Command("sh", "-c", "sleep 2 & exit 0")
+	cmd.Stdout = &bytes.Buffer{}
+	setProcessGroup(cmd)
+	start = time.Now()
+	if _, err := j.run(cmd, 0); err != errOutputLeftOpen {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("took %s waiting for output left open", took)
+	}
+}
+
+func TestItemLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "circletasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if name := sanitizeItem("tests/a b:c.go"); name != "tests_a_b_c.go" {
+		t.Fatal(name)
+	}
+	if logName("go test ./a/b") == logName("go test ./a_b") {
+		t.Fatal("items that sanitize the same should not share a log")
+	}
+	ss := testSplitServer(2, "pkg/a", "long")
+	hs := httptest.NewServer(ss)
+	defer hs.Close()
+	client := testClient(t, hs.URL, "-node_index", "1", "-log_dir", dir, "-log_max_bytes", "20", "exec", "--", "sh", "-c", `echo "out $1"; sleep 0.1; echo "err $1" >&2; [ "$1" != long ] || { sleep 0.1; echo more; }`, "sh")
+	if err := client.main(); err != nil {
+		t.Fatal(err)
+	}
+	res := ss.results()
+	for item, want := range map[string]string{
+		"pkg/a": "out pkg/a\nerr pkg/a\n",
+		"long":  "out long\nerr long\nmo\n[circletasker] dropped the last 3 bytes, logs are capped at 20 bytes\n",
+	} {
+		path := res.Outcomes[item].Log
+		if path != filepath.Join(dir, "1", logName(item)+".log") {
+			t.Fatal(path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("%s: %q", item, b)
+		}
+	}
+}
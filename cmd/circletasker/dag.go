@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resolveAfter turns the ids each item runs after into items, and fails if they form a cycle.  An
+// item can also run after a plain line, named by the line itself.
+func (a *itemAttrs) resolveAfter(items []string, after map[string][]string) error {
+	byID := make(map[string]string, len(a.IDs)+len(items))
+	for _, item := range items {
+		byID[item] = item
+	}
+	for item, id := range a.IDs {
+		byID[id] = item
+	}
+	for _, item := range items {
+		for _, ref := range after[item] {
+			dep, exists := byID[ref]
+			if !exists {
+				return fmt.Errorf("%s runs after unknown item %s", a.name(item), ref)
+			}
+			a.After[item] = append(a.After[item], dep)
+		}
+	}
+	return a.checkCycles(items)
+}
+
+// name returns the id of item, or item if it has none
+func (a *itemAttrs) name(item string) string {
+	if id, exists := a.IDs[item]; exists {
+		return id
+	}
+	return item
+}
+
+func (a *itemAttrs) checkCycles(items []string) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(items))
+	var path []string
+	var visit func(item string) error
+	visit = func(item string) error {
+		switch state[item] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for i := len(path) - 1; i >= 0; i-- {
+				if path[i] == item {
+					for _, p := range append(path[i:], item) {
+						cycle = append(cycle, a.name(p))
+					}
+					break
+				}
+			}
+			return fmt.Errorf("Dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+		state[item] = visiting
+		path = append(path, item)
+		for _, dep := range a.After[item] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[item] = visited
+		return nil
+	}
+	for _, item := range items {
+		if err := visit(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passed returns true if item finished and was not reported as failed
+func (s *splitServer) passed(item string) bool {
+	if _, finished := s.processResults[item]; !finished {
+		return false
+	}
+	outcome, reported := s.outcomes[item]
+	return !reported || outcome.Passed
+}
+
+// afterPassed returns true if every item that item runs after passed
+func (s *splitServer) afterPassed(item string) bool {
+	for _, dep := range s.attrs.After[item] {
+		if !s.passed(dep) {
+			return false
+		}
+	}
+	return true
+}
+
+// othersMayUnblock returns true if a queued item index could run waits for an item that an index
+// other than index runs
+func (s *splitServer) othersMayUnblock(index int) bool {
+	if s.draining {
+		return false
+	}
+	othersRun := false
+	for i := range s.processStartTime {
+		if i != index {
+			othersRun = true
+		}
+	}
+	if !othersRun {
+		return false
+	}
+	for _, item := range s.partsToServe {
+		if s.hasCaps(index, item) && !s.afterPassed(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipAfter takes the queued items that run after failed, directly or not, off the queue
+func (s *splitServer) skipAfter(failed string) {
+	blocked := map[string]bool{failed: true}
+	for changed := true; changed; {
+		changed = false
+		kept := make([]string, 0, len(s.partsToServe))
+		for _, item := range s.partsToServe {
+			if !s.runsAfterAny(item, blocked) {
+				kept = append(kept, item)
+				continue
+			}
+			s.log.Printf("Skipping %s, it runs after %s which failed", item, failed)
+			blocked[item] = true
+			s.skipped = append(s.skipped, item)
+			changed = true
+		}
+		s.partsToServe = kept
+	}
+}
+
+func (s *splitServer) runsAfterAny(item string, items map[string]bool) bool {
+	for _, dep := range s.attrs.After[item] {
+		if items[dep] {
+			return true
+		}
+	}
+	return false
+}
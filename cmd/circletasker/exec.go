@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exitCodeError is returned when main should exit with a specific code
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit code %d", int(e))
+}
+
+// workQueue is where a worker gets its items from and reports them to
+type workQueue interface {
+	node() int
+	next() ([]v1Item, error)
+	heartbeat() error
+	// report reports rep, returning true if the item failed and will be retried
+	report(rep itemReport) (bool, error)
+}
+
+// remoteQueue is the queue of the server this node talks to
+type remoteQueue struct {
+	*circleTasker
+}
+
+func (q remoteQueue) node() int {
+	return q.nodeIndex
+}
+
+func (q remoteQueue) next() ([]v1Item, error) {
+	return q.fetchNext(false)
+}
+
+func (q remoteQueue) report(rep itemReport) (bool, error) {
+	return q.sendReport(rep)
+}
+
+// commandArgs returns the command after the subcommand, with an optional leading --
+func (j *circleTasker) commandArgs() ([]string, error) {
+	args := j.flags.Args()[1:]
+	if len(args) != 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s needs a command to run", j.flags.Arg(0))
+	}
+	return args, nil
+}
+
+func (j *circleTasker) exec() error {
+	args, err := j.commandArgs()
+	if err != nil {
+		return err
+	}
+	if err := j.ready(); err != nil {
+		return err
+	}
+	defer j.stopItemsOnSignal()()
+	retCode, err := j.work(remoteQueue{j}, args)
+	if err != nil {
+		return err
+	}
+	if retCode != 0 {
+		return exitCodeError(retCode)
+	}
+	return nil
+}
+
+// work runs items from q until it runs out, or the process is stopped, returning the last nonzero
+// exit code of an item that is not retried
+func (j *circleTasker) work(q workQueue, args []string) (int, error) {
+	retCode := 0
+	for {
+		if err := j.checkStopped(); err != nil {
+			return retCode, err
+		}
+		items, err := q.next()
+		if err != nil {
+			return retCode, err
+		}
+		if len(items) == 0 {
+			return retCode, nil
+		}
+		for _, item := range items {
+			// the rest of the batch is left unreported for the server to hand out again
+			if err := j.checkStopped(); err != nil {
+				return retCode, err
+			}
+			rep := j.runItem(q, args, item)
+			retrying, err := q.report(rep)
+			if err != nil {
+				return retCode, err
+			}
+			if rep.ExitCode != 0 && !retrying {
+				retCode = rep.ExitCode
+			}
+		}
+	}
+}
+
+// checkStopped returns an error once items were stopped on a signal
+func (j *circleTasker) checkStopped() error {
+	select {
+	case <-j.itemsStopped:
+		return fmt.Errorf("Stopped on %s", j.stopSignal)
+	default:
+		return nil
+	}
+}
+
+func (j *circleTasker) runItem(q workQueue, args []string, v v1Item) itemReport {
+	item := v.Item
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), itemEnviron(q.node(), v)...)
+	if j.itemEnv != "" {
+		cmd.Env = append(cmd.Env, j.itemEnv+"="+item)
+	} else {
+		cmd.Args = append(cmd.Args, item)
+	}
+	stdout := &prefixWriter{prefix: "[" + item + "] ", out: j.out, mu: &j.outMu}
+	stderr := &prefixWriter{prefix: "[" + item + "] ", out: j.logOut, mu: &j.outMu}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	capture, err := j.openItemLog(q.node(), v)
+	logIfNotNil(err, "Cannot capture the output of %s", item)
+	if capture != nil {
+		cmd.Stdout = io.MultiWriter(stdout, capture)
+		cmd.Stderr = io.MultiWriter(stderr, capture)
+	}
+
+	timeout := j.itemTimeout(v)
+	setProcessGroup(cmd)
+	stopHeartbeat := j.startHeartbeat(q, v.Lease)
+	start := time.Now()
+	timedOut, err := j.run(cmd, timeout)
+	rep := itemReport{
+		Item:     item,
+		Duration: time.Since(start),
+	}
+	stopHeartbeat()
+	logIfNotNil(stdout.Flush(), "Cannot flush item stdout")
+	logIfNotNil(stderr.Flush(), "Cannot flush item stderr")
+	if capture != nil {
+		logIfNotNil(capture.Close(), "Cannot close item log %s", capture.path)
+		rep.Log = capture.path
+	}
+	if err == errOutputLeftOpen {
+		j.log.Printf("%s exited but something it started kept its output open, not waiting for it", item)
+		err = nil
+	}
+	if timedOut {
+		rep.ExitCode = timeoutExitCode
+		rep.TimedOut = true
+		rep.Message = fmt.Sprintf("timed out after %s", timeout)
+		j.log.Printf("%s timed out after %s", item, timeout)
+	} else if err != nil {
+		rep.ExitCode = 1
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+			rep.ExitCode = exitErr.ExitCode()
+		}
+		rep.Message = err.Error()
+		j.log.Printf("%s failed: %s", item, err.Error())
+	}
+	return rep
+}
+
+// timeoutExitCode is reported for items that time out, like timeout(1) exits with
+const timeoutExitCode = 124
+
+// itemTimeout returns how long v may run: its own timeout, else -timeout_factor times how long it
+// took before, else -item_timeout.  Zero means forever.
+func (j *circleTasker) itemTimeout(v v1Item) time.Duration {
+	if v.Timeout > 0 {
+		return v.Timeout
+	}
+	if j.timeoutFactor > 0 && v.Expected > 0 {
+		return time.Duration(j.timeoutFactor * float64(v.Expected))
+	}
+	return j.itemTimeoutFlag
+}
+
+// errOutputLeftOpen is returned by run when cmd exited, but processes it started still held its
+// output open -kill_after later
+var errOutputLeftOpen = errors.New("output left open by processes the item started")
+
+// itemOutput copies the output of an item from pipes, rather than leaving it to exec, so that
+// output processes the item started keep open can be given up on
+type itemOutput struct {
+	readEnds  []*os.File
+	writeEnds []*os.File
+	copied    sync.WaitGroup
+}
+
+// pipeOutput makes cmd write its output to pipes that are copied to where it went before
+func pipeOutput(cmd *exec.Cmd) (*itemOutput, error) {
+	o := &itemOutput{}
+	for _, w := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		if _, isFile := (*w).(*os.File); *w == nil || isFile {
+			continue
+		}
+		r, pw, err := os.Pipe()
+		if err != nil {
+			o.started()
+			o.wait(0)
+			return nil, err
+		}
+		o.readEnds = append(o.readEnds, r)
+		o.writeEnds = append(o.writeEnds, pw)
+		o.copied.Add(1)
+		go func(out io.Writer) {
+			defer o.copied.Done()
+			// Reading fails once wait gives up on the pipe and closes it, which is not worth a log
+			io.Copy(out, r)
+		}(*w)
+		*w = pw
+	}
+	return o, nil
+}
+
+// started closes the write ends, which only the item needs once it started
+func (o *itemOutput) started() {
+	for _, pw := range o.writeEnds {
+		logIfNotNil(pw.Close(), "Cannot close item output pipe")
+	}
+}
+
+// wait waits up to d, or for as long as it takes if d is zero, for the output to be copied.  It
+// returns false if it gave up on it.
+func (o *itemOutput) wait(d time.Duration) bool {
+	copied := make(chan struct{})
+	go func() {
+		o.copied.Wait()
+		close(copied)
+	}()
+	var expired <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	done := true
+	select {
+	case <-copied:
+	case <-expired:
+		done = false
+	}
+	for _, r := range o.readEnds {
+		logIfNotNil(r.Close(), "Cannot close item output pipe")
+	}
+	return done
+}
+
+// run runs cmd, returning true if it timed out.  Once timeout passes, the process group of cmd
+// gets SIGTERM, or the signal the process got if it is stopped first, and SIGKILL if it is still
+// running -kill_after later.  Output left open by processes cmd started is not waited for longer
+// than that either.
+func (j *circleTasker) run(cmd *exec.Cmd, timeout time.Duration) (bool, error) {
+	output, err := pipeOutput(cmd)
+	if err != nil {
+		return false, err
+	}
+	err = cmd.Start()
+	output.started()
+	if err != nil {
+		output.wait(0)
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if !output.wait(j.killAfter) && err == nil {
+			err = errOutputLeftOpen
+		}
+		done <- err
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	timedOut := false
+	select {
+	case err := <-done:
+		return false, err
+	case <-expired:
+		timedOut = true
+		logIfNotNil(terminateGroup(cmd), "Cannot terminate timed out item")
+	case <-j.itemsStopped:
+		logIfNotNil(signalGroup(cmd, j.stopSignal), "Cannot pass %s on to item", j.stopSignal)
+	}
+	kill := time.NewTimer(j.killAfter)
+	defer kill.Stop()
+	select {
+	case err := <-done:
+		return timedOut, err
+	case <-kill.C:
+	}
+	j.log.Printf("Killing item still running %s after it was asked to stop", j.killAfter)
+	logIfNotNil(killGroup(cmd), "Cannot kill item")
+	return timedOut, <-done
+}
+
+// itemEnviron returns the env vars that tell a command about the item it runs
+func itemEnviron(node int, v v1Item) []string {
+	env := []string{
+		"CIRCLETASKER_ITEM=" + v.Item,
+		"CIRCLETASKER_ITEM_ID=" + v.ID,
+		"CIRCLETASKER_ATTEMPT=" + strconv.Itoa(v.Attempt),
+		"CIRCLETASKER_NODE_INDEX=" + strconv.Itoa(node),
+	}
+	if v.Expected > 0 {
+		env = append(env, "CIRCLETASKER_EXPECTED_DURATION="+strconv.FormatFloat(v.Expected.Seconds(), 'f', -1, 64))
+	}
+	return env
+}
+
+// startHeartbeat renews the running item's lease until the returned func is called.  Without
+// -heartbeat, it renews three times per lease timeout.
+func (j *circleTasker) startHeartbeat(q workQueue, lease *v1Lease) func() {
+	interval := j.heartbeatInterval
+	if interval <= 0 && lease != nil {
+		interval = lease.Timeout / 3
+	}
+	if interval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				logIfNotNil(q.heartbeat(), "Cannot renew lease")
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// prefixWriter writes each line to out starting with prefix.  Writers that share mu never
+// interleave partial lines, even across local workers.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf.Write(b)
+	for {
+		idx := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if idx < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf.Next(idx + 1)); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Flush writes out any trailing partial line
+func (p *prefixWriter) Flush() error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	return p.writeLine(append(p.buf.Next(p.buf.Len()), '\n'))
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := io.WriteString(p.out, p.prefix); err != nil {
+		return err
+	}
+	_, err := p.out.Write(line)
+	return err
+}
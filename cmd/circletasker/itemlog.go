@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxLogName is the longest file name, without the hash and .log, that an item log gets
+const maxLogName = 128
+
+// itemLog captures the combined output of an item into -log_dir/<node>/<item>-<hash>.log.  Output beyond
+// -log_max_bytes is dropped, and so is output once the file cannot be written, so the item itself
+// never sees an error.
+type itemLog struct {
+	path    string
+	f       *os.File
+	mu      sync.Mutex
+	max     int64
+	written int64
+	dropped int64
+	err     error
+}
+
+// openItemLog creates the log of v on node, or returns nil if there is no -log_dir
+func (j *circleTasker) openItemLog(node int, v v1Item) (*itemLog, error) {
+	if j.logDir == "" {
+		return nil, nil
+	}
+	dir := filepath.Join(j.logDir, strconv.Itoa(node))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := logName(v.Item)
+	if v.Attempt > 1 {
+		name += fmt.Sprintf(".attempt%d", v.Attempt)
+	}
+	path := filepath.Join(dir, name+".log")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &itemLog{path: path, f: f, max: j.logMaxBytes}, nil
+}
+
+// logName returns the file name of the log of item.  Items that sanitize to the same name still
+// get logs of their own, as the name ends in a hash of the item.
+func logName(item string) string {
+	sum := sha1.Sum([]byte(item))
+	return sanitizeItem(item) + "-" + hex.EncodeToString(sum[:4])
+}
+
+// sanitizeItem turns item into a file name, replacing anything but letters, digits, dots, dashes
+// and underscores with underscores
+func sanitizeItem(item string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, item)
+	if len(name) > maxLogName {
+		name = name[:maxLogName]
+	}
+	if strings.Trim(name, ".") == "" {
+		name = strings.Replace(name, ".", "_", -1) + "_"
+	}
+	return name
+}
+
+func (l *itemLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keep := int64(len(b))
+	if left := l.max - l.written; keep > left {
+		keep = left
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	if keep > 0 && l.err == nil {
+		var n int
+		n, l.err = l.f.Write(b[:keep])
+		l.written += int64(n)
+		logIfNotNil(l.err, "Cannot write item log %s", l.path)
+	}
+	l.dropped += int64(len(b)) - keep
+	return len(b), nil
+}
+
+// Close notes how much output was dropped, if any, and closes the file
+func (l *itemLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dropped > 0 && l.err == nil {
+		_, l.err = fmt.Fprintf(l.f, "\n[circletasker] dropped the last %d bytes, logs are capped at %d bytes\n", l.dropped, l.max)
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	return l.err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lines on stdin are items, optionally followed by attributes separated by tabs, like
+//  item	tags=docker,linux	priority=10	timeout=5m
+// or JSON objects whose cmd is handed out as the item, like
+//  {"id": "test", "cmd": "make test-image", "after": ["build"], "tags": ["docker"], "priority": 10, "timeout": "5m"}
+// An item with tags is only handed to nodes that declare every one of them with -caps.  An item
+// with after is only handed out once the items with those ids passed.  Items with a higher
+// priority are handed out first; the default is 0.  An item with a timeout is stopped once it runs
+// that long, whatever -item_timeout says.
+
+const capsHeader = "X-caps"
+
+// itemAttrs holds what stdin says about its items besides the items themselves
+type itemAttrs struct {
+	Tags  map[string][]string `json:"tags,omitempty"`
+	After map[string][]string `json:"after,omitempty"`
+	IDs   map[string]string   `json:"ids,omitempty"`
+
+	Priority map[string]int           `json:"priority,omitempty"`
+	Timeout  map[string]time.Duration `json:"timeout,omitempty"`
+}
+
+// dagItem is a stdin line in JSON form
+type dagItem struct {
+	ID    string   `json:"id"`
+	Cmd   string   `json:"cmd"`
+	After []string `json:"after,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
+	Priority int    `json:"priority,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// jsonLines is what parseJSON learned from the lines before
+type jsonLines struct {
+	// after holds the ids each item runs after, to resolve once every line is read
+	after map[string][]string
+	byID  map[string]string
+	items map[string]struct{}
+}
+
+// parseItems splits lines into their items and what the lines say about them
+func parseItems(lines []string) ([]string, itemAttrs, error) {
+	attrs := itemAttrs{
+		Tags:  make(map[string][]string),
+		After: make(map[string][]string),
+		IDs:   make(map[string]string),
+
+		Priority: make(map[string]int),
+		Timeout:  make(map[string]time.Duration),
+	}
+	items := make([]string, 0, len(lines))
+	seen := jsonLines{
+		after: make(map[string][]string),
+		byID:  make(map[string]string),
+		items: make(map[string]struct{}),
+	}
+	for _, line := range lines {
+		var item string
+		var err error
+		if strings.HasPrefix(line, "{") {
+			item, err = attrs.parseJSON(line, &seen)
+		} else {
+			item, err = attrs.parseLine(line)
+		}
+		if err != nil {
+			return nil, itemAttrs{}, err
+		}
+		items = append(items, item)
+	}
+	if err := attrs.resolveAfter(items, seen.after); err != nil {
+		return nil, itemAttrs{}, err
+	}
+	return items, attrs, nil
+}
+
+func (a *itemAttrs) parseLine(line string) (string, error) {
+	fields := strings.Split(line, "\t")
+	item := strings.TrimSpace(fields[0])
+	for _, attr := range fields[1:] {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("Invalid attribute %q of %s: expected key=value", attr, item)
+		}
+		switch kv[0] {
+		case "tags":
+			if t := splitList(kv[1]); len(t) != 0 {
+				a.Tags[item] = t
+			}
+		case "priority":
+			p, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return "", fmt.Errorf("Invalid priority %s of %s", kv[1], item)
+			}
+			a.Priority[item] = p
+		case "timeout":
+			if err := a.setTimeout(item, kv[1]); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("Unknown attribute %s of %s", kv[0], item)
+		}
+	}
+	return item, nil
+}
+
+// parseJSON parses a dagItem line, and adds it to seen
+func (a *itemAttrs) parseJSON(line string, seen *jsonLines) (string, error) {
+	var d dagItem
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&d); err != nil {
+		return "", fmt.Errorf("Invalid item %s: %s", line, err.Error())
+	}
+	item := d.Cmd
+	if item == "" {
+		item = d.ID
+	}
+	if item == "" {
+		return "", fmt.Errorf("Item %s needs an id or a cmd", line)
+	}
+	if _, dup := seen.items[item]; dup {
+		return "", fmt.Errorf("Item %s appears more than once", item)
+	}
+	seen.items[item] = struct{}{}
+	if d.ID != "" {
+		if other, dup := seen.byID[d.ID]; dup {
+			return "", fmt.Errorf("Items %s and %s share id %s", other, item, d.ID)
+		}
+		seen.byID[d.ID] = item
+		a.IDs[item] = d.ID
+	}
+	if len(d.Tags) != 0 {
+		a.Tags[item] = d.Tags
+	}
+	if len(d.After) != 0 {
+		seen.after[item] = d.After
+	}
+	if d.Priority != 0 {
+		a.Priority[item] = d.Priority
+	}
+	if d.Timeout != "" {
+		if err := a.setTimeout(item, d.Timeout); err != nil {
+			return "", err
+		}
+	}
+	return item, nil
+}
+
+func (a *itemAttrs) setTimeout(item string, timeout string) error {
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("Invalid timeout %s of %s", timeout, item)
+	}
+	a.Timeout[item] = d
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var ret []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			ret = append(ret, part)
+		}
+	}
+	return ret
+}
+
+// hasCaps returns true if index declared every tag item needs
+func (s *splitServer) hasCaps(index int, item string) bool {
+	for _, tag := range s.attrs.Tags[item] {
+		found := false
+		for _, c := range s.caps[index] {
+			if c == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// canRun returns true if index can run item now
+func (s *splitServer) canRun(index int, item string) bool {
+	return s.hasCaps(index, item) && s.afterPassed(item)
+}
+
+// hasWorkFor returns true if the queue holds an item index can run
+func (s *splitServer) hasWorkFor(index int) bool {
+	for _, item := range s.partsToServe {
+		if s.canRun(index, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// unscheduled returns an error naming the items still queued once every node is done, because no
+// node had the tags they need or they run after items that never ran
+func (s *splitServer) unscheduled() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.partsToServe) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.partsToServe))
+	for _, item := range s.partsToServe {
+		if tags := s.attrs.Tags[item]; len(tags) != 0 {
+			item += " (" + strings.Join(tags, ",") + ")"
+		}
+		names = append(names, item)
+	}
+	return fmt.Errorf("%d items could never be scheduled: %s", len(names), strings.Join(names, ", "))
+}
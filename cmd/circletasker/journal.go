@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// journalEvent is one line of the server journal.  Replaying every event of a journal rebuilds the
+// state of the server that wrote it.
+type journalEvent struct {
+	Event  string      `json:"event"`
+	Time   time.Time   `json:"time"`
+	Index  int         `json:"index"`
+	Item   string      `json:"item,omitempty"`
+	Items  []string    `json:"items,omitempty"`
+	Report *itemReport `json:"report,omitempty"`
+
+	Attrs *itemAttrs `json:"attrs,omitempty"`
+
+	// RequestID is the request a serve, done or report event answers, First marks the first serve
+	// event of an answer
+	RequestID string `json:"request_id,omitempty"`
+	First     bool   `json:"first,omitempty"`
+}
+
+// record appends ev to the journal, if there is one
+func (s *splitServer) record(ev journalEvent) {
+	if s.journal == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	logIfNotNil(s.journal.Encode(ev), "Cannot append %s to journal", ev.Event)
+}
+
+// readJournal returns every event in filename, and how many bytes of it they take up.  A partial
+// last line, left by a crash while it was written, is ignored.
+func readJournal(filename string, r io.Reader) ([]journalEvent, int64, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	events := make([]journalEvent, 0, 100)
+	var size int64
+	var badLine error
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if badLine != nil {
+			return nil, 0, badLine
+		}
+		var ev journalEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			badLine = fmt.Errorf("invalid journal line %s:%d: %s", filename, lineNum, err.Error())
+			continue
+		}
+		events = append(events, ev)
+		size += int64(len(line))
+	}
+	if len(events) == 0 || events[0].Event != "queue" {
+		return nil, 0, fmt.Errorf("journal %s does not start with the queue", filename)
+	}
+	return events, size, nil
+}
+
+// replay applies events without recording them again
+func (s *splitServer) replay(events []journalEvent) error {
+	journal := s.journal
+	s.journal = nil
+	defer func() {
+		s.journal = journal
+	}()
+	for _, ev := range events {
+		if err := s.apply(ev); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for index := range s.seen {
+		s.seen[index] = now
+	}
+	for _, held := range s.processStartTime {
+		for i := range held {
+			held[i].renewTime = now
+		}
+	}
+	return nil
+}
+
+func (s *splitServer) apply(ev journalEvent) error {
+	switch ev.Event {
+	case "queue":
+		s.setQueue(ev.Items)
+	case "ready":
+		s.markReady(ev.Index)
+	case "serve":
+		s.handOut(ev.Index, ev.Item, ev.Time, ev.RequestID, ev.First)
+	case "complete":
+		s.finishItem(ev.Index, ev.Time)
+	case "requeue":
+		s.requeueUnreported(ev.Index, ev.Time)
+	case "report":
+		if ev.Report == nil {
+			return errors.New("journal report event without a report")
+		}
+		s.recordReport(ev.Index, *ev.Report, ev.Time, ev.RequestID)
+	case "done":
+		s.markDone(ev.Index, ev.RequestID)
+	case "expire":
+		s.expireLease(ev.Index, ev.Time)
+	default:
+		return fmt.Errorf("unknown journal event %s", ev.Event)
+	}
+	return nil
+}
+
+// openJournal starts the journal of ss.  When resuming it returns the events of the previous
+// server, and false if there was no journal to resume from.
+func (j *circleTasker) openJournal(ss *splitServer) ([]journalEvent, bool, error) {
+	if j.journal == "" {
+		if j.resume {
+			return nil, false, errors.New("cannot resume without a journal")
+		}
+		return nil, false, nil
+	}
+	var events []journalEvent
+	var size int64
+	if j.resume {
+		f, err := os.Open(j.journal)
+		if os.IsNotExist(err) {
+			j.log.Printf("No journal at %s, starting a new run", j.journal)
+			j.resume = false
+			return j.openJournal(ss)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		events, size, err = readJournal(j.journal, f)
+		logIfNotNil(f.Close(), "Cannot close journal")
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	f, err := os.OpenFile(j.journal, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	// A new run starts an empty journal, a resumed one drops the partial line a crash left behind
+	if err := f.Truncate(size); err != nil {
+		logIfNotNil(f.Close(), "Cannot close journal")
+		return nil, false, err
+	}
+	ss.journalFile = f
+	ss.journal = json.NewEncoder(f)
+	return events, j.resume, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// localQueue hands one in-process worker its items straight from the server's queue
+type localQueue struct {
+	s     *splitServer
+	index int
+	batch int
+	caps  []string
+}
+
+func (q localQueue) node() int {
+	return q.index
+}
+
+func (q localQueue) next() ([]v1Item, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+	q.s.requeueUnreported(q.index, time.Now())
+	for {
+		items, _, perr := q.s.next(q.index, q.batch, q.caps, "")
+		if perr == errHold {
+			continue
+		}
+		if perr != nil {
+			return nil, perr
+		}
+		return q.s.v1Items(q.index, items), nil
+	}
+}
+
+func (q localQueue) heartbeat() error {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+	if perr := q.s.renew(q.index); perr != nil {
+		return perr
+	}
+	return nil
+}
+
+func (q localQueue) report(rep itemReport) (bool, error) {
+	q.s.mu.Lock()
+	defer q.s.mu.Unlock()
+	retrying, perr := q.s.applyReport(q.index, rep, "")
+	if perr != nil {
+		return false, perr
+	}
+	return retrying, nil
+}
+
+// local runs the items on stdin with -workers workers in this process, sharing a queue the same
+// way nodes share a server's
+func (j *circleTasker) local() error {
+	args, err := j.commandArgs()
+	if err != nil {
+		return err
+	}
+	if j.workers < 1 {
+		return errors.New("local needs at least one worker")
+	}
+	lines, err := j.readLines()
+	if err != nil {
+		return err
+	}
+	items, attrs, err := parseItems(lines)
+	if err != nil {
+		return err
+	}
+	ss := j.newSplitServer(j.workers)
+	ss.attrs = attrs
+	ss.leaseTimeout = 0
+	if err := j.orderQueue(ss, items, false); err != nil {
+		return err
+	}
+	ss.setQueue(items)
+	defer func() {
+		logIfNotNil(j.writeResults(ss), "Cannot write results to %s", j.runRes)
+	}()
+	defer stopOnSignal(ss)()
+	defer j.stopItemsOnSignal()()
+
+	codes := make([]int, j.workers)
+	errs := make([]error, j.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < j.workers; i++ {
+		ss.mu.Lock()
+		ss.markReady(i)
+		ss.mu.Unlock()
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			codes[index], errs[index] = j.work(localQueue{s: ss, index: index, batch: j.batch, caps: splitList(j.caps)}, args)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	if err := ss.interruptedError(); err != nil {
+		return err
+	}
+	if err := ss.unscheduled(); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if code != 0 {
+			return exitCodeError(code)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Nodes join by sending ready, or any request.  The server stops once every node that joined was
+// released, either told it is done or idle for -idle_timeout, and -node_total nodes joined or
+// -join_grace passed.
+
+// touch notes that index was heard from at now, joining it if it is new
+func (s *splitServer) touch(index int, now time.Time) {
+	if _, joined := s.seen[index]; !joined && len(s.seen) >= s.nodeTotal {
+		s.log.Printf("Index %d joined beyond the %d expected nodes", index, s.nodeTotal)
+	}
+	s.seen[index] = now
+}
+
+// finished returns true once every node that joined was released, and either nodeTotal nodes
+// joined or the join grace period is over
+func (s *splitServer) finished(now time.Time) bool {
+	if !s.released() {
+		return false
+	}
+	if len(s.seen) >= s.nodeTotal {
+		return true
+	}
+	return s.joinGrace > 0 && !now.Before(s.joinDeadline)
+}
+
+// released returns true once every node that joined was released
+func (s *splitServer) released() bool {
+	for index := range s.seen {
+		if _, released := s.haveToldDone[index]; !released {
+			return false
+		}
+	}
+	return true
+}
+
+// waitFinished blocks until the server is finished, or drained once it is interrupted
+func (s *splitServer) waitFinished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.joinDeadline = time.Now().Add(s.joinGrace)
+	if s.joinGrace > 0 {
+		t := time.AfterFunc(s.joinGrace, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.workChanged.Broadcast()
+		})
+		defer t.Stop()
+	}
+	for !s.finished(time.Now()) && s.interrupted == "" {
+		s.workChanged.Wait()
+	}
+	if s.interrupted != "" {
+		s.drain()
+		return
+	}
+	if len(s.seen) < s.nodeTotal {
+		joined := make([]int, 0, len(s.seen))
+		for index := range s.seen {
+			joined = append(joined, index)
+		}
+		s.log.Printf("Stopping after the join grace period: nodes %s never arrived", joinIndexes(missingIndexes(joined, s.nodeTotal)))
+	}
+}
+
+// missingIndexes returns the indexes below nodeTotal that are not in indexes
+func missingIndexes(indexes []int, nodeTotal int) []int {
+	have := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		have[index] = true
+	}
+	var ret []int
+	for index := 0; index < nodeTotal; index++ {
+		if !have[index] {
+			ret = append(ret, index)
+		}
+	}
+	return ret
+}
+
+// expireIdle releases nodes that hold no items and were not heard from within the idle timeout.
+// A node can wait up to holdTimeout for an answer to next, so it gets that much longer.
+func (s *splitServer) expireIdle(now time.Time) {
+	if s.idleTimeout <= 0 {
+		return
+	}
+	idle := make([]int, 0, len(s.seen))
+	for index, seen := range s.seen {
+		if _, released := s.haveToldDone[index]; released {
+			continue
+		}
+		if _, holds := s.processStartTime[index]; holds {
+			continue
+		}
+		if now.Sub(seen) >= s.idleTimeout+s.holdTimeout {
+			idle = append(idle, index)
+		}
+	}
+	sort.Ints(idle)
+	for _, index := range idle {
+		s.log.Printf("Index %d timed out: last heard from %s ago", index, now.Sub(s.seen[index]))
+		s.expireLease(index, now)
+	}
+}
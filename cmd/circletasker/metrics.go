@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// durationBuckets are the upper bounds, in seconds, of the item duration histogram
+var durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// serverMetrics holds the counters of a splitServer.  Gauges are read from the server state when
+// scraped.
+type serverMetrics struct {
+	itemsServed    int64
+	itemsCompleted map[string]int64
+	protocolErrors map[string]int64
+
+	durationCounts []int64
+	durationCount  int64
+	durationSum    float64
+}
+
+func newServerMetrics() serverMetrics {
+	return serverMetrics{
+		itemsCompleted: make(map[string]int64),
+		protocolErrors: make(map[string]int64),
+		durationCounts: make([]int64, len(durationBuckets)),
+	}
+}
+
+func (m *serverMetrics) completed(result string, d time.Duration) {
+	m.itemsCompleted[result]++
+	m.durationCount++
+	m.durationSum += d.Seconds()
+	for i, upper := range durationBuckets {
+		if d.Seconds() <= upper {
+			m.durationCounts[i]++
+		}
+	}
+}
+
+func (m *serverMetrics) protocolError(reason string) {
+	m.protocolErrors[reason]++
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeLabeled(w io.Writer, name string, label string, values map[string]int64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+func (s *splitServer) writeMetrics(w io.Writer) {
+	m := &s.metrics
+	writeMetricHeader(w, "circletasker_items_served_total", "counter", "Items handed out to nodes.")
+	fmt.Fprintf(w, "circletasker_items_served_total %d\n", m.itemsServed)
+
+	writeMetricHeader(w, "circletasker_items_completed_total", "counter", "Items nodes finished, by result.")
+	writeLabeled(w, "circletasker_items_completed_total", "result", m.itemsCompleted)
+
+	writeMetricHeader(w, "circletasker_item_duration_seconds", "histogram", "How long items took to run.")
+	for i, upper := range durationBuckets {
+		fmt.Fprintf(w, "circletasker_item_duration_seconds_bucket{le=\"%g\"} %d\n", upper, m.durationCounts[i])
+	}
+	fmt.Fprintf(w, "circletasker_item_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "circletasker_item_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "circletasker_item_duration_seconds_count %d\n", m.durationCount)
+
+	writeMetricHeader(w, "circletasker_queue_depth", "gauge", "Items not yet handed out.")
+	fmt.Fprintf(w, "circletasker_queue_depth %d\n", len(s.partsToServe))
+
+	writeMetricHeader(w, "circletasker_items_in_flight", "gauge", "Items each node is running.")
+	inFlight := make(map[string]int64, len(s.seen))
+	for index := range s.seen {
+		inFlight[fmt.Sprintf("%d", index)] = 0
+	}
+	for index, held := range s.processStartTime {
+		inFlight[fmt.Sprintf("%d", index)] += int64(len(held))
+	}
+	writeLabeled(w, "circletasker_items_in_flight", "index", inFlight)
+
+	writeMetricHeader(w, "circletasker_protocol_errors_total", "counter", "Requests the server rejected, by reason.")
+	writeLabeled(w, "circletasker_protocol_errors_total", "reason", m.protocolErrors)
+}
+
+func (s *splitServer) serveMetrics(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(rw)
+}
@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing, as there are no process groups to signal
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// terminateGroup kills cmd, as it cannot be asked to stop
+func terminateGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// signalGroup kills cmd, as it cannot be passed sig
+func signalGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}
+
+// killGroup kills cmd
+func killGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long the server waits for requests in progress once it stops
+const shutdownTimeout = time.Second * 5
+
+// stopOnSignal interrupts ss once the process gets SIGTERM or SIGINT.  A second signal kills the
+// process as usual.  The returned func stops listening for signals.
+func stopOnSignal(ss *splitServer) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			ss.interrupt(sig.String())
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// stopItemsOnSignal passes SIGTERM or SIGINT on to the items j runs, as they run in process groups
+// of their own, and stops j from running more.  The returned func stops listening for signals.
+func (j *circleTasker) stopItemsOnSignal() func() {
+	j.itemsStopped = make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			j.stopItems(sig)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// stopItems passes sig on to the items j runs, and stops j from running more
+func (j *circleTasker) stopItems(sig os.Signal) {
+	j.log.Printf("Stopping on %s", sig)
+	j.stopSignal = sig
+	close(j.itemsStopped)
+}
+
+// interrupt stops handing out items.  Nodes are told they are done the next time they ask, and the
+// server stops once they all were, or -drain_timeout passed.
+func (s *splitServer) interrupt(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.interrupted != "" {
+		return
+	}
+	s.log.Printf("Stopping on %s: %d items running, %d never started", reason, s.inFlight(), len(s.partsToServe))
+	s.interrupted = reason
+	s.draining = true
+	s.notStarted = append(s.notStarted, s.partsToServe...)
+	s.partsToServe = nil
+	s.workChanged.Broadcast()
+}
+
+// drain waits until every node that joined was told to stop, for at most drainTimeout, so nodes
+// can still report the items they run and hear that they are done
+func (s *splitServer) drain() {
+	if s.drainTimeout > 0 {
+		deadline := time.Now().Add(s.drainTimeout)
+		t := time.AfterFunc(s.drainTimeout, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.workChanged.Broadcast()
+		})
+		defer t.Stop()
+		for !s.released() && time.Now().Before(deadline) {
+			s.workChanged.Wait()
+		}
+	}
+	var untold []int
+	for index := range s.seen {
+		if _, released := s.haveToldDone[index]; !released {
+			untold = append(untold, index)
+		}
+	}
+	if len(untold) != 0 {
+		sort.Ints(untold)
+		s.log.Printf("Stopping before nodes %s were told to stop", joinIndexes(untold))
+	}
+}
+
+func (s *splitServer) inFlight() int {
+	n := 0
+	for _, held := range s.processStartTime {
+		n += len(held)
+	}
+	return n
+}
+
+// runningItems returns the items nodes still run, in index order
+func (s *splitServer) runningItems() []string {
+	indexes := make([]int, 0, len(s.processStartTime))
+	for index := range s.processStartTime {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	var ret []string
+	for _, index := range indexes {
+		for _, st := range s.processStartTime[index] {
+			ret = append(ret, st.sentItem)
+		}
+	}
+	return ret
+}
+
+// interruptedError returns an error if the server was interrupted
+func (s *splitServer) interruptedError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.interrupted == "" {
+		return nil
+	}
+	return fmt.Errorf("Stopped early on %s", s.interrupted)
+}
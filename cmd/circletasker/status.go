@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const statusPath = "/status"
+
+type serverStatus struct {
+	Remaining []string      `json:"remaining"`
+	Running   []runningItem `json:"running"`
+	Completed []doneItem    `json:"completed"`
+	Ready     []int         `json:"ready"`
+	Done      []int         `json:"done"`
+	Lost      []int         `json:"lost,omitempty"`
+}
+
+type runningItem struct {
+	Index      int           `json:"index"`
+	Item       string        `json:"item"`
+	Started    time.Time     `json:"started"`
+	RunningFor time.Duration `json:"running_for"`
+}
+
+type doneItem struct {
+	Item     string        `json:"item"`
+	Duration time.Duration `json:"duration"`
+	Outcome  *itemOutcome  `json:"outcome,omitempty"`
+}
+
+func sortedIndexes(m map[int]struct{}) []int {
+	ret := make([]int, 0, len(m))
+	for index := range m {
+		ret = append(ret, index)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+func (s *splitServer) status(now time.Time) serverStatus {
+	ret := serverStatus{
+		Remaining: append([]string{}, s.partsToServe...),
+		Running:   make([]runningItem, 0, len(s.processStartTime)),
+		Completed: make([]doneItem, 0, len(s.processResults)),
+		Ready:     sortedIndexes(s.indexIsReady),
+		Done:      sortedIndexes(s.haveToldDone),
+		Lost:      sortedIndexes(s.lostIndexes),
+	}
+	for index, held := range s.processStartTime {
+		for _, st := range held {
+			ret.Running = append(ret.Running, runningItem{
+				Index:      index,
+				Item:       st.sentItem,
+				Started:    st.sendTime,
+				RunningFor: now.Sub(st.sendTime),
+			})
+		}
+	}
+	sort.SliceStable(ret.Running, func(i, j int) bool {
+		return ret.Running[i].Index < ret.Running[j].Index
+	})
+	for item, d := range s.processResults {
+		di := doneItem{
+			Item:     item,
+			Duration: d,
+		}
+		if o, exists := s.outcomes[item]; exists {
+			di.Outcome = &o
+		}
+		ret.Completed = append(ret.Completed, di)
+	}
+	sort.Slice(ret.Completed, func(i, j int) bool {
+		return ret.Completed[i].Item < ret.Completed[j].Item
+	})
+	return ret
+}
+
+func (s *splitServer) serveStatus(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	logIfNotNil(json.NewEncoder(rw).Encode(s.status(time.Now())), "Cannot write response to client")
+}
+
+func (j *circleTasker) status() error {
+	req, err := j.newRequest("GET", statusPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		logIfNotNil(resp.Body.Close(), "cannot close client response body")
+	}()
+	if resp.StatusCode != http.StatusOK {
+		b, err := ioutil.ReadAll(resp.Body)
+		logIfNotNil(err, "Cannot read from response body")
+		j.log.Println(string(b))
+		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+	var st serverStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return err
+	}
+	return printStatus(j.out, st)
+}
+
+func joinIndexes(indexes []int) string {
+	parts := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		parts = append(parts, fmt.Sprintf("%d", index))
+	}
+	return strings.Join(parts, " ")
+}
+
+func printStatus(out io.Writer, st serverStatus) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Ready nodes:\t%s\n", joinIndexes(st.Ready))
+	fmt.Fprintf(w, "Done nodes:\t%s\n", joinIndexes(st.Done))
+	if len(st.Lost) != 0 {
+		fmt.Fprintf(w, "Lost nodes:\t%s\n", joinIndexes(st.Lost))
+	}
+	fmt.Fprintf(w, "\nRunning (%d)\n", len(st.Running))
+	for _, r := range st.Running {
+		fmt.Fprintf(w, "  %d\t%s\t%s\n", r.Index, r.Item, r.RunningFor.Round(time.Second))
+	}
+	fmt.Fprintf(w, "\nRemaining (%d)\n", len(st.Remaining))
+	for _, item := range st.Remaining {
+		fmt.Fprintf(w, "  %s\n", item)
+	}
+	fmt.Fprintf(w, "\nCompleted (%d)\n", len(st.Completed))
+	for _, c := range st.Completed {
+		result := ""
+		if c.Outcome != nil {
+			result = fmt.Sprintf("node %d exit %d", c.Outcome.Index, c.Outcome.ExitCode)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", c.Item, c.Duration, result)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+func (j *circleTasker) usesTLS() bool {
+	return j.caFile != "" || j.certFile != ""
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates in %s", filename)
+	}
+	return pool, nil
+}
+
+// clientTLS returns the config to verify the server with -ca and present -cert/-key to it
+func (j *circleTasker) clientTLS() (*tls.Config, error) {
+	conf := &tls.Config{}
+	if j.caFile != "" {
+		pool, err := loadCertPool(j.caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if j.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(j.certFile, j.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// serverTLS returns the TLS config serve listens with, or nil to listen in plain text
+func (j *circleTasker) serverTLS() (*tls.Config, error) {
+	conf := &tls.Config{}
+	switch {
+	case j.selfSigned:
+		cert, err := j.selfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case j.tlsCert != "":
+		cert, err := tls.LoadX509KeyPair(j.tlsCert, j.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case j.clientCA != "":
+		return nil, errors.New("-client_ca needs -tls_cert or -self_signed")
+	default:
+		return nil, nil
+	}
+	if j.clientCA != "" {
+		pool, err := loadCertPool(j.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// selfSignedCert makes an ephemeral CA, writes it to -self_signed_ca for the clients' -ca, and
+// signs a server certificate for every name and address of this host
+func (j *circleTasker) selfSignedCert() (tls.Certificate, error) {
+	ca, caKey, err := newCA()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	if err := ioutil.WriteFile(j.selfSignedCA, caPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	j.log.Printf("Wrote self signed CA to %s", j.selfSignedCA)
+	return issueCert(ca, caKey, localNames(j.listenHost), false)
+}
+
+// localNames returns the host names and addresses clients may use to reach this host
+func localNames(listenHost string) []string {
+	names := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(listenHost); err == nil && host != "" && host != "0.0.0.0" && host != "::" {
+		names = append(names, host)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				names = append(names, ipNet.IP.String())
+			}
+		}
+	}
+	return names
+}
+
+func newCA() (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "circletasker ephemeral CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// issueCert signs a certificate for names with ca, for a client if client is true and a server
+// otherwise
+func issueCert(ca *x509.Certificate, caKey crypto.Signer, names []string, client bool) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     ca.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
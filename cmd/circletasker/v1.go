@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The v1 protocol POSTs a JSON v1Request to a v1 path and always gets a JSON v1Response back
+const (
+	v1Prefix        = "/v1/"
+	v1ReadyPath     = "/v1/ready"
+	v1NextPath      = "/v1/next"
+	v1HeartbeatPath = "/v1/heartbeat"
+	v1ReportPath    = "/v1/report"
+)
+
+type v1Request struct {
+	Index  int         `json:"index"`
+	Batch  int         `json:"batch,omitempty"`
+	Report *itemReport `json:"report,omitempty"`
+	Caps   []string    `json:"caps,omitempty"`
+
+	// RequestID lets the server answer a retried next with the items it already handed out
+	RequestID string `json:"request_id,omitempty"`
+	// Finished tells next that the items the node holds ran, for clients that do not report them.
+	// Otherwise they go back to the queue.
+	Finished bool `json:"finished,omitempty"`
+}
+
+type v1Response struct {
+	Items []v1Item       `json:"items,omitempty"`
+	Done  bool           `json:"done,omitempty"`
+	Error *protocolError `json:"error,omitempty"`
+
+	// Ready answers ready with the indexes that checked in, out of NodeTotal expected
+	Ready     []int `json:"ready,omitempty"`
+	NodeTotal int   `json:"node_total,omitempty"`
+
+	// Retrying answers a report of a failed item the server queued again
+	Retrying bool `json:"retrying,omitempty"`
+}
+
+type v1Item struct {
+	ID      string   `json:"id"`
+	Item    string   `json:"item"`
+	Attempt int      `json:"attempt"`
+	Lease   *v1Lease `json:"lease,omitempty"`
+
+	// Expected is how long the item took in -prev_results, if it ran there
+	Expected time.Duration `json:"expected,omitempty"`
+	// Timeout overrides how long the item may run, if stdin gave it one
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+type v1Lease struct {
+	Timeout time.Duration `json:"timeout"`
+	Expires time.Time     `json:"expires"`
+}
+
+func (s *splitServer) serveV1(rw http.ResponseWriter, req *http.Request) {
+	var in v1Request
+	var resp v1Response
+	newlyDone := false
+	if req.Method != "POST" {
+		resp.Error = s.reject(http.StatusMethodNotAllowed, "invalid_request", "v1 requests must be POST, not %s", req.Method)
+	} else if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		resp.Error = s.reject(http.StatusBadRequest, "invalid_request", "Invalid v1 request: %s", err.Error())
+	} else if resp.Error = s.checkIndex(in.Index); resp.Error == nil {
+		switch req.URL.Path {
+		case v1ReadyPath:
+			s.ready(in.Index)
+			resp.Ready = sortedIndexes(s.indexIsReady)
+			resp.NodeTotal = s.nodeTotal
+		case v1HeartbeatPath:
+			resp.Error = s.renew(in.Index)
+		case v1ReportPath:
+			if in.Report == nil {
+				resp.Error = s.reject(http.StatusBadRequest, "invalid_report", "Report from index %d without a report", in.Index)
+			} else {
+				resp.Retrying, resp.Error = s.applyReport(in.Index, *in.Report, in.RequestID)
+			}
+		case v1NextPath:
+			// A retry can arrive while the server still holds the request it retries
+			for in.RequestID != "" && s.nextPending[in.Index] == in.RequestID {
+				s.workChanged.Wait()
+			}
+			if last, exists := s.lastNext[in.Index]; exists && in.RequestID != "" && last.requestID == in.RequestID {
+				s.log.Printf("Answering next %s from index %d again", in.RequestID, in.Index)
+				resp.Items = s.v1Items(in.Index, last.items)
+				resp.Done = last.done
+				break
+			}
+			var items []string
+			if in.Batch < 1 {
+				in.Batch = 1
+			}
+			if in.Finished {
+				s.finishItem(in.Index, time.Now())
+			} else {
+				s.requeueUnreported(in.Index, time.Now())
+			}
+			if in.RequestID != "" {
+				s.nextPending[in.Index] = in.RequestID
+			}
+			items, newlyDone, resp.Error = s.next(in.Index, in.Batch, in.Caps, in.RequestID)
+			if s.nextPending[in.Index] == in.RequestID {
+				delete(s.nextPending, in.Index)
+				s.workChanged.Broadcast()
+			}
+			resp.Items = s.v1Items(in.Index, items)
+			resp.Done = resp.Error == nil && len(items) == 0
+		default:
+			resp.Error = s.reject(http.StatusNotFound, "unknown_path", "Unknown path %s", req.URL.Path)
+		}
+	}
+	writeV1(rw, resp)
+	if newlyDone {
+		flushResponse(rw)
+	}
+}
+
+// writeV1 writes resp, with the status of its error if it has one
+func writeV1(rw http.ResponseWriter, resp v1Response) {
+	rw.Header().Set("Content-Type", "application/json")
+	if resp.Error != nil {
+		if resp.Error == errHold {
+			rw.Header().Set("Retry-After", "1")
+		}
+		rw.WriteHeader(resp.Error.status)
+	}
+	logIfNotNil(json.NewEncoder(rw).Encode(resp), "Cannot write response to client")
+}
+
+// lastNext is the answer to the last next request of an index that had an ID
+type lastNext struct {
+	requestID string
+	items     []string
+	done      bool
+}
+
+// lastReport is the answer to the last report of an index that had an ID
+type lastReport struct {
+	requestID string
+	retrying  bool
+}
+
+func (s *splitServer) v1Items(index int, items []string) []v1Item {
+	ret := make([]v1Item, 0, len(items))
+	for _, item := range items {
+		v := v1Item{
+			ID:      s.itemIDs[item],
+			Item:    item,
+			Attempt: len(s.attempts[item]) + 1,
+
+			Expected: s.expected[item],
+			Timeout:  s.attrs.Timeout[item],
+		}
+		if s.leaseTimeout > 0 {
+			st, _ := s.heldItem(index, item)
+			v.Lease = &v1Lease{
+				Timeout: s.leaseTimeout,
+				Expires: st.renewTime.Add(s.leaseTimeout),
+			}
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+var errUnauthorized = errors.New("server rejected the -token")
+
+// newRequestID returns a random ID for a request that may be retried
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (j *circleTasker) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, j.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+	if j.token != "" {
+		req.Header.Set("Authorization", bearerPrefix+j.token)
+	}
+	return req, nil
+}
+
+// call POSTs in to a v1 path.  Requests the server rejects return a *protocolError.
+func (j *circleTasker) call(path string, in v1Request) (v1Response, error) {
+	var out v1Response
+	b, err := json.Marshal(in)
+	if err != nil {
+		return out, err
+	}
+	req, err := j.newRequest("POST", path, bytes.NewReader(b))
+	if err != nil {
+		return out, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return out, err
+	}
+	defer func() {
+		logIfNotNil(resp.Body.Close(), "cannot close client response body")
+	}()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return out, errUnauthorized
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return out, err
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		j.log.Println(string(body))
+		return out, fmt.Errorf("invalid response with status code %s: %s", strconv.Itoa(resp.StatusCode), err.Error())
+	}
+	if out.Error != nil {
+		out.Error.status = resp.StatusCode
+		return out, out.Error
+	}
+	return out, nil
+}
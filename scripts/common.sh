@@ -180,13 +180,28 @@ function circletasker_execute() {
     ssh -M -S "my-ctrl-socket$CIRCLE_NODE_INDEX" -fnNT -4 -L 12012:localhost:12012 node0
     ssh -S "my-ctrl-socket$CIRCLE_NODE_INDEX" -O check node0
   fi
-  circletasker ready
-  TOCHECK=$(circletasker next)
   RET_CODE="0"
-  while [ ! -z "$TOCHECK" ]; do
-    $1 "$TOCHECK" || RET_CODE="$?"
+  # $1 may carry its own arguments, so it is split on purpose.  circletasker exec can only run
+  # executables, so when $1 names a shell function the items are run from a bash loop instead,
+  # which reports each exit code back to the server.
+  read -r -a CMD <<< "$1"
+  if [ "$(type -t "${CMD[0]}")" = "function" ]; then
+    circletasker ready
     TOCHECK=$(circletasker next)
-  done
+    while [ -n "$TOCHECK" ]; do
+      ITEM_CODE="0"
+      # shellcheck disable=SC2086
+      $1 "$TOCHECK" || ITEM_CODE="$?"
+      if [ "$ITEM_CODE" != "0" ]; then
+        RET_CODE="$ITEM_CODE"
+      fi
+      circletasker -exit_code "$ITEM_CODE" report
+      TOCHECK=$(circletasker next)
+    done
+  else
+    # shellcheck disable=SC2086
+    circletasker exec -- $1 || RET_CODE="$?"
+  fi
   if [ "$CIRCLE_NODE_INDEX" == "0" ]; then
     wait
   else